@@ -29,5 +29,11 @@ import (
 func main() {
 	log.SetOutput(os.Stdout)
 
-	skel.PluginMain(cni.CmdAdd, cni.CmdGet, cni.CmdDel, version.All, "msm-cni")
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cni.CmdAdd,
+		Check:  cni.CmdCheck,
+		Del:    cni.CmdDel,
+		GC:     cni.CmdGC,
+		Status: cni.CmdStatus,
+	}, version.All, "msm-cni")
 }
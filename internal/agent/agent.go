@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package agent implements the node agent serving pod metadata to msm-cni over a Unix socket,
+// so that the plugin does not query the API server on every ADD.
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// resyncPeriod is how often the informers replay their cache
+	resyncPeriod = 10 * time.Minute
+	// podPathPrefix is the path the pods are served at, followed by <namespace>/<name>
+	podPathPrefix = "/pods/"
+	// logsPath is the path msm-cni posts its log lines to, they are written to the agent log output
+	logsPath = "/logs"
+	// maxLogsSize bounds the log lines accepted in a single request
+	maxLogsSize = 1 << 20
+)
+
+// Pod is the pod metadata served by the agent
+type Pod struct {
+	Name           string            `json:"name"`
+	Namespace      string            `json:"namespace"`
+	Containers     []string          `json:"containers"`
+	InitContainers []string          `json:"initContainers"`
+	Labels         map[string]string `json:"labels"`
+	Annotations    map[string]string `json:"annotations"`
+	// NamespaceLabels are the labels of the pod namespace, nil when it is not known
+	NamespaceLabels map[string]string `json:"namespaceLabels"`
+	// ContainerUIDs are the UIDs the containers run as, for those setting runAsUser
+	ContainerUIDs map[string]string `json:"containerUIDs"`
+}
+
+// Server keeps the pods of a node and their namespaces in informer caches and serves them over a Unix socket
+type Server struct {
+	client     kubernetes.Interface
+	nodeName   string
+	socketPath string
+}
+
+// NewServer returns a Server for the pods scheduled on nodeName
+func NewServer(client kubernetes.Interface, nodeName, socketPath string) *Server {
+	return &Server{
+		client:     client,
+		nodeName:   nodeName,
+		socketPath: socketPath,
+	}
+}
+
+// Run syncs the informers then serves the pod metadata until ctx is done
+func (s *Server) Run(ctx context.Context) error {
+	// only the pods of this node are watched, the namespaces are few and all of them are
+	podInformers := informers.NewSharedInformerFactoryWithOptions(s.client, resyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", s.nodeName).String()
+		}))
+	namespaceInformers := informers.NewSharedInformerFactory(s.client, resyncPeriod)
+	pods := podInformers.Core().V1().Pods().Lister()
+	namespaces := namespaceInformers.Core().V1().Namespaces().Lister()
+
+	podInformers.Start(ctx.Done())
+	namespaceInformers.Start(ctx.Done())
+	for _, factory := range []informers.SharedInformerFactory{podInformers, namespaceInformers} {
+		for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return fmt.Errorf("failed to sync the %v informer", informerType)
+			}
+		}
+	}
+	log.Infof("Pod metadata cache synced for node %s", s.nodeName)
+
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+podPathPrefix+"{namespace}/{name}", s.handlePod(pods, namespaces))
+	mux.HandleFunc("POST "+logsPath, s.handleLogs)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.Infof("Serving pod metadata on %s", s.socketPath)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// listen creates the Unix socket, replacing the one a previous agent may have left behind
+func (s *Server) listen() (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// msm-cni runs as root, nobody else needs the pod metadata
+	if err := os.Chmod(s.socketPath, 0o600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (s *Server) handlePod(pods listersv1.PodLister, namespaces listersv1.NamespaceLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, name := r.PathValue("namespace"), r.PathValue("name")
+
+		pod, err := pods.Pods(namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var namespaceLabels map[string]string
+		if ns, err := namespaces.Get(namespace); err == nil {
+			namespaceLabels = ns.Labels
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(podFromObject(pod, namespaceLabels)); err != nil {
+			log.Warnf("Failed to write the metadata of pod %s/%s: %v", namespace, name, err)
+		}
+	}
+}
+
+// handleLogs writes the log lines of an msm-cni run to the agent log output, so that they show up in the
+// logs of the installer container
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	logs, err := io.ReadAll(io.LimitReader(r.Body, maxLogsSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out := log.StandardLogger().Out
+	if _, err := out.Write(logs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func podFromObject(pod *corev1.Pod, namespaceLabels map[string]string) *Pod {
+	p := &Pod{
+		Name:            pod.Name,
+		Namespace:       pod.Namespace,
+		Labels:          pod.Labels,
+		Annotations:     pod.Annotations,
+		NamespaceLabels: namespaceLabels,
+		ContainerUIDs:   ContainerUIDs(pod),
+	}
+	for _, container := range pod.Spec.InitContainers {
+		p.InitContainers = append(p.InitContainers, container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		p.Containers = append(p.Containers, container.Name)
+	}
+	return p
+}
+
+// ContainerUIDs returns the UIDs the containers and init containers of the pod run as, from their
+// security context or else the pod one. The containers running as the image user are left out.
+func ContainerUIDs(pod *corev1.Pod) map[string]string {
+	var podUID *int64
+	if pod.Spec.SecurityContext != nil {
+		podUID = pod.Spec.SecurityContext.RunAsUser
+	}
+
+	uids := make(map[string]string)
+	for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		uid := podUID
+		if container.SecurityContext != nil && container.SecurityContext.RunAsUser != nil {
+			uid = container.SecurityContext.RunAsUser
+		}
+		if uid != nil {
+			uids[container.Name] = strconv.FormatInt(*uid, 10)
+		}
+	}
+	return uids
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNodeName = "node-1"
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestServer(t *testing.T) {
+	media := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "media",
+		Labels: map[string]string{"sidecar.mediastreamingmesh.io/inject": "true"},
+	}}
+	camera := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cam-0",
+			Namespace:   "media",
+			Labels:      map[string]string{"app": "camera"},
+			Annotations: map[string]string{"sidecar.mediastreamingmesh.io/inject": "false"},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:        testNodeName,
+			SecurityContext: &corev1.PodSecurityContext{RunAsUser: int64Ptr(1000)},
+			InitContainers:  []corev1.Container{{Name: "init"}},
+			Containers: []corev1.Container{
+				{Name: "app"},
+				{Name: "proxy", SecurityContext: &corev1.SecurityContext{RunAsUser: int64Ptr(1337)}},
+			},
+		},
+	}
+	// the namespace of this pod is not known to the agent
+	orphan := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "orphan", Namespace: "gone"},
+		Spec:       corev1.PodSpec{NodeName: testNodeName, Containers: []corev1.Container{{Name: "app"}}},
+	}
+
+	client := fake.NewSimpleClientset(media, camera, orphan)
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServer(client, testNodeName, socketPath).Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	})
+	waitForSocket(t, socketPath)
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket mode = %o, want 600", perm)
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		podName   string
+		want      *Pod
+		wantErr   error
+	}{
+		{
+			name:      "found",
+			namespace: "media",
+			podName:   "cam-0",
+			want: &Pod{
+				Name:            "cam-0",
+				Namespace:       "media",
+				Containers:      []string{"app", "proxy"},
+				InitContainers:  []string{"init"},
+				Labels:          camera.Labels,
+				Annotations:     camera.Annotations,
+				NamespaceLabels: media.Labels,
+				ContainerUIDs:   map[string]string{"init": "1000", "app": "1000", "proxy": "1337"},
+			},
+		},
+		{
+			name:      "unknown namespace",
+			namespace: "gone",
+			podName:   "orphan",
+			want: &Pod{
+				Name:          "orphan",
+				Namespace:     "gone",
+				Containers:    []string{"app"},
+				ContainerUIDs: map[string]string{},
+			},
+		},
+		{name: "not found", namespace: "media", podName: "cam-1", wantErr: ErrPodNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetPod(context.Background(), socketPath, tt.namespace, tt.podName)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("GetPod() = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetPod() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// waitForSocket waits for the Server to serve on socketPath, once its caches are synced
+func waitForSocket(t *testing.T, socketPath string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := GetPod(context.Background(), socketPath, "default", "probe")
+		if err == nil || errors.Is(err, ErrPodNotFound) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the agent does not serve on %s: %v", socketPath, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// clientTimeout bounds a query to the agent, the caller falls back to the API server when it expires
+const clientTimeout = 2 * time.Second
+
+// ErrPodNotFound is returned by GetPod when the pod is not in the agent cache (yet)
+var ErrPodNotFound = errors.New("pod not found in the agent cache")
+
+// newClient returns an HTTP client connecting to the agent listening on socketPath
+func newClient(socketPath string) *http.Client {
+	return &http.Client{
+		Timeout: clientTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// GetPod queries the agent listening on socketPath for the metadata of a pod
+func GetPod(ctx context.Context, socketPath, namespace, name string) (*Pod, error) {
+	// the host is ignored, the connection always goes to the socket
+	reqURL := "http://agent" + podPathPrefix + url.PathEscape(namespace) + "/" + url.PathEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newClient(socketPath).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrPodNotFound
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("agent returned %s: %s", resp.Status, body)
+	}
+
+	pod := &Pod{}
+	if err := json.NewDecoder(resp.Body).Decode(pod); err != nil {
+		return nil, fmt.Errorf("failed to decode the agent response: %v", err)
+	}
+	return pod, nil
+}
+
+// SendLogs posts log lines to the agent listening on socketPath, which writes them to its log output
+func SendLogs(ctx context.Context, socketPath string, logs []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://agent"+logsPath, bytes.NewReader(logs))
+	if err != nil {
+		return err
+	}
+	resp, err := newClient(socketPath).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("agent returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
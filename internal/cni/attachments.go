@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/state"
+)
+
+// attachmentStore returns the store of the redirects programmed on the node
+func attachmentStore(conf *PluginConf) *state.Store {
+	if conf.StateDir != "" {
+		return state.NewStore(conf.StateDir)
+	}
+	return state.NewStore(state.DefaultDir)
+}
+
+// recordAttachment records the redirect programmed by backend for the attachment. The rules are
+// in place whatever happens to the record, a failure is only logged.
+func recordAttachment(conf *PluginConf, args *skel.CmdArgs, k8sArgs KubernetesArgs, backend string, redirect *Redirect) {
+	attachment := &state.Attachment{
+		Network:      conf.Name,
+		ContainerID:  args.ContainerID,
+		IfName:       args.IfName,
+		PodName:      string(k8sArgs.K8S_POD_NAME),
+		PodNamespace: string(k8sArgs.K8S_POD_NAMESPACE),
+		Netns:        args.Netns,
+		Backend:      backend,
+		Params:       redirect.ruleParams(),
+		RuleHash:     ruleHash(backend, redirect),
+		Created:      time.Now(),
+	}
+	if err := attachmentStore(conf).Put(attachment); err != nil {
+		log.Warnf("Failed to record the redirect of container %s: %v", args.ContainerID, err)
+	}
+}
+
+// lookupAttachment returns the record of the attachment, nil when there is none or it cannot be read
+func lookupAttachment(conf *PluginConf, args *skel.CmdArgs) *state.Attachment {
+	attachment, err := attachmentStore(conf).Get(args.ContainerID, args.IfName)
+	if err != nil {
+		if !errors.Is(err, state.ErrNotFound) {
+			log.Warnf("Failed to read the redirect record of container %s: %v", args.ContainerID, err)
+		}
+		return nil
+	}
+	return attachment
+}
+
+// forgetAttachment removes the record of the attachment
+func forgetAttachment(conf *PluginConf, args *skel.CmdArgs) {
+	if err := attachmentStore(conf).Delete(args.ContainerID, args.IfName); err != nil {
+		log.Warnf("Failed to remove the redirect record of container %s: %v", args.ContainerID, err)
+	}
+}
+
+// cleanupAttachment removes the rules of a recorded attachment from its netns, when it is still there
+func cleanupAttachment(attachment *state.Attachment) {
+	if _, err := os.Stat(attachment.Netns); os.IsNotExist(err) {
+		return
+	}
+	intMgrCt := GetInterceptRuleMgrCtor(attachment.Backend)
+	if intMgrCt == nil {
+		log.Warnf("Cannot clean up the redirect of container %s, unavailable InterceptRuleMgr of type %s",
+			attachment.ContainerID, attachment.Backend)
+		return
+	}
+	if err := intMgrCt().Cleanup(attachment.Netns, redirectFromParams(attachment.Params)); err != nil {
+		var netnsErr *NetnsError
+		if !errors.As(err, &netnsErr) || !netnsErr.NotExist() {
+			log.Warnf("Failed to clean up the redirect of container %s in netns %s: %v",
+				attachment.ContainerID, attachment.Netns, err)
+		}
+		return
+	}
+	log.Infof("Cleaned up the redirect of container %s in netns %s", attachment.ContainerID, attachment.Netns)
+}
+
+// recordedRedirect returns the backend and the rule hash of the redirect recorded by ADD in the store.
+// The msm key of the ADD result is no help here, the runtimes parse the result into the typed CNI
+// result and drop it before CHECK. The hash is empty without a record.
+func recordedRedirect(conf *PluginConf, args *skel.CmdArgs) (backend, hash string) {
+	if attachment := lookupAttachment(conf, args); attachment != nil {
+		return attachment.Backend, attachment.RuleHash
+	}
+	return "", ""
+}
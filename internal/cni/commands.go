@@ -18,39 +18,104 @@ package cni
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"time"
+	"path"
+	"runtime/debug"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
 )
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
+// The errors are CNI errors, ready to be returned to the runtime.
 func parseConfig(stdin []byte) (*PluginConf, error) {
 	conf := PluginConf{}
 
 	if err := json.Unmarshal(stdin, &conf); err != nil {
-		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+		return nil, types.NewError(types.ErrDecodingFailure, "failed to parse network configuration", err.Error())
+	}
+
+	for _, port := range conf.Kubernetes.InterceptPorts {
+		if err := rules.ValidatePortRange(port); err != nil {
+			return nil, configError("invalid interceptPorts in network configuration: %v", err)
+		}
+	}
+	for _, port := range conf.Kubernetes.UDPInterceptPorts {
+		if err := rules.ValidatePortRange(port); err != nil {
+			return nil, configError("invalid udpInterceptPorts in network configuration: %v", err)
+		}
+	}
+	switch conf.Kubernetes.RedirectMode {
+	case "", rules.RedirectModeREDIRECT, rules.RedirectModeTPROXY:
+	default:
+		return nil, configError("invalid redirectMode %s in network configuration", conf.Kubernetes.RedirectMode)
+	}
+	policies := []string{conf.Kubernetes.FailurePolicy}
+	for _, override := range conf.Kubernetes.FailurePolicyOverrides {
+		if len(override.Namespaces) == 0 || override.FailurePolicy == "" {
+			return nil, configError("failurePolicyOverrides entries need namespaces and a failurePolicy in network configuration")
+		}
+		policies = append(policies, override.FailurePolicy)
+	}
+	for _, policy := range policies {
+		switch policy {
+		case "", failurePolicyFail, failurePolicyIgnore:
+		default:
+			return nil, configError("invalid failurePolicy %s in network configuration, expected %s or %s",
+				policy, failurePolicyFail, failurePolicyIgnore)
+		}
+	}
+	if conf.Delegate != nil {
+		if pluginType, ok := conf.Delegate["type"].(string); !ok || pluginType == "" {
+			return nil, configError("delegate needs a type in network configuration")
+		}
+	}
+	if err := conf.Log.validate(conf.LogLevel); err != nil {
+		return nil, configError("%v in network configuration", err)
+	}
+	if _, err := conf.Kubernetes.RetryPolicy.parse(); err != nil {
+		return nil, configError("%v in network configuration", err)
+	}
+	patterns := append(append([]string{}, conf.Kubernetes.IncludeNamespaces...), conf.Kubernetes.ExcludeNamespaces...)
+	for _, override := range conf.Kubernetes.FailurePolicyOverrides {
+		patterns = append(patterns, override.Namespaces...)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, configError("invalid namespace pattern %q in network configuration: %v", pattern, err)
+		}
+	}
+	for name, selector := range map[string]*metav1.LabelSelector{
+		"podSelector":       conf.Kubernetes.PodSelector,
+		"namespaceSelector": conf.Kubernetes.NamespaceSelector,
+	} {
+		if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+			return nil, configError("invalid %s in network configuration: %v", name, err)
+		}
 	}
 
 	// Parse previous CNI config result. This is for when the CNI plugin is chained
 	if conf.RawPrevResult != nil {
 		resultBytes, err := json.Marshal(conf.RawPrevResult)
 		if err != nil {
-			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+			return nil, types.NewError(types.ErrDecodingFailure, "could not serialize prevResult", err.Error())
 		}
 		res, err := version.NewResult(conf.CNIVersion, resultBytes)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse prevResult: %v", err)
+			return nil, types.NewError(types.ErrDecodingFailure, "could not parse prevResult", err.Error())
 		}
 		conf.RawPrevResult = nil
 		conf.PrevResult, err = current.NewResultFromResult(res)
 		if err != nil {
-			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+			return nil, types.NewError(types.ErrIncompatibleCNIVersion, "could not convert result to current version", err.Error())
 		}
 	}
 	// End previous result parsing
@@ -58,32 +123,100 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 	return &conf, nil
 }
 
-// CmdAdd is called for pod ADD requests
-func CmdAdd(args *skel.CmdArgs) error {
-	// open a file
-	f, err := os.OpenFile("/var/log/testlogrus.log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o666)
-	if err != nil {
-		fmt.Printf("error opening file: %v", err)
+// configError returns the CNI error for an invalid network configuration
+func configError(format string, args ...interface{}) *types.Error {
+	return types.NewError(types.ErrInvalidNetworkConfig, "invalid network configuration", fmt.Sprintf(format, args...))
+}
+
+// podLookupError returns the CNI error for a failed pod lookup, the transient failures can be tried again later
+func podLookupError(err error) *types.Error {
+	if _, retriable := classifyError(err); retriable {
+		return types.NewError(types.ErrTryAgainLater, "failed to get pod metadata", err.Error())
 	}
-	// don't forget to close it
-	defer f.Close()
+	return types.NewError(types.ErrInternal, "failed to get pod metadata", err.Error())
+}
 
-	// Log as JSON instead of the default ASCII formatter.
-	log.SetFormatter(&log.JSONFormatter{
-		PrettyPrint: true,
-	})
+// applyPluginConf overrides the package defaults with the values set in the plugin configuration
+func applyPluginConf(conf *PluginConf) {
+	if conf.Kubernetes.CNIBinDir != "" {
+		nsSetupBinDir = conf.Kubernetes.CNIBinDir
+	}
+	if conf.Kubernetes.InterceptRuleMgrType != "" {
+		interceptRuleMgrType = conf.Kubernetes.InterceptRuleMgrType
+	}
+	if len(conf.Kubernetes.InterceptPorts) > 0 {
+		interceptPorts = conf.Kubernetes.InterceptPorts
+	}
+	if conf.Kubernetes.RedirectMode != "" {
+		redirectMode = conf.Kubernetes.RedirectMode
+	}
+	if len(conf.Kubernetes.UDPInterceptPorts) > 0 {
+		udpInterceptPorts = conf.Kubernetes.UDPInterceptPorts
+	}
+}
 
-	// Output to stderr instead of stdout, could also be a file.
-	log.SetOutput(f)
+// failurePolicy returns the failure policy of the namespace: the one of the first failurePolicyOverrides
+// entry matching it, or failurePolicy
+func failurePolicy(conf *PluginConf, namespace string) string {
+	for _, override := range conf.Kubernetes.FailurePolicyOverrides {
+		if matchNamespace(override.Namespaces, namespace) {
+			return override.FailurePolicy
+		}
+	}
+	if conf.Kubernetes.FailurePolicy == "" {
+		return defaultFailurePolicy
+	}
+	return conf.Kubernetes.FailurePolicy
+}
 
-	log.Infof("got into cmdadd")
-	// Defer a panic recover, so that in case if panic we can still return
-	// a proper error to the runtime.
-	defer func() {
-		if err := recover(); err != nil {
-			log.Errorf("msm-cni cmdAdd error: %v", err)
+// applyFailurePolicy returns err with the Fail policy. With Ignore it logs err and returns nil,
+// and the pod runs without the redirection.
+func applyFailurePolicy(policy, step string, err error) error {
+	if policy == failurePolicyIgnore {
+		log.Warnf("Pod redirect skipped after a %s failure, failurePolicy is %s: %v", step, policy, err)
+		return nil
+	}
+	log.Errorf("Pod redirect failed on %s, failurePolicy is %s: %v", step, policy, err)
+	return err
+}
+
+// isExcludedNamespace checks if the namespace is excluded by excludeNamespaces, or not included
+// by includeNamespaces when it is set
+func isExcludedNamespace(conf *PluginConf, namespace string) bool {
+	if matchNamespace(conf.Kubernetes.ExcludeNamespaces, namespace) {
+		return true
+	}
+	return len(conf.Kubernetes.IncludeNamespaces) > 0 && !matchNamespace(conf.Kubernetes.IncludeNamespaces, namespace)
+}
+
+// matchNamespace reports whether the namespace matches any of the glob patterns
+func matchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		// the patterns are validated with the configuration
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
 		}
-	}()
+	}
+	return false
+}
+
+// recoverPanic turns a panic of a CNI command into an internal error result, logging its stack.
+// It must be deferred by the command, with err its named result.
+func recoverPanic(command string, err *error) {
+	if r := recover(); r != nil {
+		log.Errorf("msm-cni %s panicked: %v\n%s", command, r, debug.Stack())
+		*err = types.NewError(types.ErrInternal, fmt.Sprintf("msm-cni %s panicked", command), fmt.Sprint(r))
+	}
+}
+
+// CmdAdd is called for pod ADD requests
+func CmdAdd(args *skel.CmdArgs) (err error) {
+	// don't forget to close the log file
+	defer setupLogging(args)()
+
+	log.Infof("got into cmdadd")
+	// a panic still returns a proper error to the runtime, the pod must not start without the redirection
+	defer recoverPanic("ADD", &err)
 
 	log.Infof("before parse")
 
@@ -107,84 +240,34 @@ func CmdAdd(args *skel.CmdArgs) error {
 	// Determine if running under k8s by checking the CNI args
 	k8sArgs := KubernetesArgs{}
 	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
-		return err
+		return types.NewError(types.ErrInvalidEnvironmentVariables, "failed to load CNI_ARGS", err.Error())
 	}
 	log.Infof("Getting identifiers with arguments: %s", args.Args)
 	log.Infof("Loaded k8s arguments: %v", k8sArgs)
 
-	if conf.Kubernetes.CNIBinDir != "" {
-		nsSetupBinDir = conf.Kubernetes.CNIBinDir
-	}
-	if conf.Kubernetes.InterceptRuleMgrType != "" {
-		interceptRuleMgrType = conf.Kubernetes.InterceptRuleMgrType
+	applyPluginConf(conf)
+
+	// in standalone mode the delegate sets up the pod interface, its result is the one to pass through
+	if conf.Delegate != nil {
+		if conf.PrevResult != nil {
+			return configError("delegate is set but msm-cni is chained after another plugin")
+		}
+		if conf.PrevResult, err = delegate(conf, "ADD"); err != nil {
+			return err
+		}
 	}
 
 	// Check if the workload is running under Kubernetes.
+	var redirect *RedirectResult
 	if string(k8sArgs.K8S_POD_NAMESPACE) != "" && string(k8sArgs.K8S_POD_NAME) != "" {
-		excludePod := false
-		// check if pod belongs to an excluded namespace defined in the plugin configuration
-		for _, excludeNs := range conf.Kubernetes.ExcludeNamespaces {
-			if string(k8sArgs.K8S_POD_NAMESPACE) == excludeNs {
-				excludePod = true
-				break
-			}
-		}
-
-		if !excludePod {
-			// create a kubernetes API client
-			client, err := newKubeClient(*conf)
-			if err != nil {
-				log.Errorf("Failed to create kubernetes client, err=%v", err)
-				return err
-			}
-
-			podInfo := &PodInfo{}
-			for retry := 1; retry <= podRetrievalMaxRetries; retry++ {
-				podInfo, err = getKubePodInfo(client, string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE))
-				if err == nil {
-					break
+		if redirect, err = setupRedirect(args, conf, k8sArgs); err != nil {
+			if conf.Delegate != nil {
+				// the pod does not start, its interface and address are released
+				if _, delErr := delegate(conf, "DEL"); delErr != nil {
+					log.Errorf("Failed to release the delegate interface: %v", delErr)
 				}
-				log.Warnf("Waiting for pod metadata, err=%v, retry=%d/%d", err, retry, podRetrievalMaxRetries)
-				time.Sleep(podRetrievalInterval)
 			}
-			// error after reaching max retries number
-			if err != nil {
-				log.Errorf("Failed to get pod data, err=%v", err)
-				return err
-			}
-
-			if len(podInfo.Containers) >= 1 {
-				log.Infof("Found containers %v", podInfo.Containers)
-
-				// check label before invoking redirect commands
-				if _, ok := podInfo.Labels[msmSideCarLabel]; !ok {
-					log.Infof("Pod %s excluded - no sidecar label", string(k8sArgs.K8S_POD_NAME))
-					excludePod = true
-				}
-
-				if !excludePod {
-					log.Infof("setting up redirect")
-
-					redirect, err := NewRedirect(podInfo)
-					if err != nil {
-						log.Errorf("Pod redirect failed due to bad params: %v", err)
-						return err
-					} else {
-						intMgrCt := GetInterceptRuleMgrCtor(interceptRuleMgrType)
-						if intMgrCt == nil {
-							log.Errorf("Pod redirect failed due to unavailable InterceptRuleMgr of type %s",
-								interceptRuleMgrType)
-						} else {
-							rulesMgr := intMgrCt()
-							if err := rulesMgr.Program(args.Netns, redirect); err != nil {
-								return err
-							}
-						}
-					}
-				}
-			}
-		} else {
-			log.Infof("Pod is excluded from msm-cni")
+			return err
 		}
 	} else {
 		log.Infof("Pod is not running under Kubernetes")
@@ -200,17 +283,245 @@ func CmdAdd(args *skel.CmdArgs) error {
 		result = conf.PrevResult
 	}
 
-	return types.PrintResult(result, conf.CNIVersion)
+	return printResult(result, redirect, conf.CNIVersion)
+}
+
+// setupRedirect redirects the pod traffic to the MSM proxy when the pod is selected. The failures
+// go through the failure policy of the pod namespace: they fail the ADD with Fail, and leave the
+// pod running without the redirection with Ignore. It returns the record of the redirect, nil when the
+// pod is not redirected. The returned errors are CNI errors.
+func setupRedirect(args *skel.CmdArgs, conf *PluginConf, k8sArgs KubernetesArgs) (*RedirectResult, error) {
+	namespace := string(k8sArgs.K8S_POD_NAMESPACE)
+	// check if pod belongs to an excluded namespace defined in the plugin configuration
+	if isExcludedNamespace(conf, namespace) {
+		log.Infof("Pod is excluded from msm-cni")
+		return nil, nil
+	}
+	policy := failurePolicy(conf, namespace)
+
+	podInfo, err := getPodInfo(conf, k8sArgs)
+	if err != nil {
+		return nil, applyFailurePolicy(policy, "pod lookup", podLookupError(err))
+	}
+	if len(podInfo.Containers) == 0 {
+		return nil, nil
+	}
+	log.Infof("Found containers %v", podInfo.Containers)
+
+	// check label before invoking redirect commands
+	inject, reason := sideCarInjection(conf, podInfo)
+	if !inject {
+		log.Infof("Pod %s excluded - %s", string(k8sArgs.K8S_POD_NAME), reason)
+		return nil, nil
+	}
+	log.Infof("Pod %s redirected - %s", string(k8sArgs.K8S_POD_NAME), reason)
+
+	log.Infof("setting up redirect")
+
+	redirect, err := NewRedirect(podInfo, conf.PrevResult)
+	if err != nil {
+		log.Errorf("Pod redirect failed due to bad params: %v", err)
+		return nil, types.NewError(types.ErrInvalidNetworkConfig, "invalid redirect parameters", err.Error())
+	}
+
+	intMgrCt := GetInterceptRuleMgrCtor(interceptRuleMgrType)
+	if intMgrCt == nil {
+		return nil, applyFailurePolicy(policy, "intercept rule manager",
+			types.NewError(types.ErrInvalidNetworkConfig, "unavailable InterceptRuleMgr",
+				fmt.Sprintf("no InterceptRuleMgr of type %s", interceptRuleMgrType)))
+	}
+
+	// the rule set is programmed as a whole, the error names the rule that failed
+	if err := intMgrCt().Program(args.Netns, redirect); err != nil {
+		var netnsErr *NetnsError
+		if errors.As(err, &netnsErr) {
+			return nil, applyFailurePolicy(policy, "rule programming",
+				types.NewError(types.ErrInvalidNetNS, "pod netns is not accessible", err.Error()))
+		}
+		return nil, applyFailurePolicy(policy, "rule programming",
+			types.NewError(ErrCodeRulesProgramming, "failed to program redirect rules", err.Error()))
+	}
+	recordAttachment(conf, args, k8sArgs, interceptRuleMgrType, redirect)
+	return newRedirectResult(interceptRuleMgrType, redirect), nil
 }
 
-// CmdGet is called for pod Get requests
-func CmdGet(args *skel.CmdArgs) error {
-	log.Info("CmdGet not implemented")
-	return fmt.Errorf("CmdGet not implemented")
+// CmdCheck is called for pod CHECK requests. It re-reads the pod metadata and
+// verifies that the redirect rules expected for the pod are installed in its netns.
+func CmdCheck(args *skel.CmdArgs) (err error) {
+	defer setupLogging(args)()
+	defer recoverPanic("CHECK", &err)
+
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		log.Errorf("error parsing msm-cni cmdCheck config: %v", err)
+		return err
+	}
+
+	k8sArgs := KubernetesArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		return types.NewError(types.ErrInvalidEnvironmentVariables, "failed to load CNI_ARGS", err.Error())
+	}
+	log.Infof("CmdCheck for container %s, netns=%s, args=%s", args.ContainerID, args.Netns, args.Args)
+
+	if conf.Delegate != nil {
+		if _, err := delegate(conf, "CHECK"); err != nil {
+			return err
+		}
+	}
+
+	if string(k8sArgs.K8S_POD_NAMESPACE) == "" || string(k8sArgs.K8S_POD_NAME) == "" {
+		log.Infof("Pod is not running under Kubernetes")
+		return nil
+	}
+	if isExcludedNamespace(conf, string(k8sArgs.K8S_POD_NAMESPACE)) {
+		log.Infof("Pod is excluded from msm-cni")
+		return nil
+	}
+
+	applyPluginConf(conf)
+	// with Ignore ADD may have let the pod run without the redirection, CHECK tolerates the same failures
+	policy := failurePolicy(conf, string(k8sArgs.K8S_POD_NAMESPACE))
+
+	podInfo, err := getPodInfo(conf, k8sArgs)
+	if err != nil {
+		return applyFailurePolicy(policy, "pod lookup", podLookupError(err))
+	}
+	if len(podInfo.Containers) == 0 {
+		log.Infof("Pod %s has no containers, nothing to check", string(k8sArgs.K8S_POD_NAME))
+		return nil
+	}
+	if inject, reason := sideCarInjection(conf, podInfo); !inject {
+		log.Infof("Pod %s is not redirected - %s, nothing to check", string(k8sArgs.K8S_POD_NAME), reason)
+		return nil
+	}
+
+	if _, err := os.Stat(args.Netns); err != nil {
+		return types.NewError(types.ErrInvalidNetNS, "pod netns is not accessible", err.Error())
+	}
+
+	redirect, err := NewRedirect(podInfo, conf.PrevResult)
+	if err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid redirect parameters", err.Error())
+	}
+	// the rules recorded by ADD cannot match when the redirect changed since
+	if backend, hash := recordedRedirect(conf, args); hash != "" && hash != ruleHash(interceptRuleMgrType, redirect) {
+		return types.NewError(ErrCodeRulesDrift, "redirect rules have drifted",
+			fmt.Sprintf("the %s rules recorded in the state store (%s) differ from the expected ones", backend, hash))
+	}
+
+	intMgrCt := GetInterceptRuleMgrCtor(interceptRuleMgrType)
+	if intMgrCt == nil {
+		return applyFailurePolicy(policy, "intercept rule manager",
+			types.NewError(types.ErrInvalidNetworkConfig, "unavailable InterceptRuleMgr",
+				fmt.Sprintf("no InterceptRuleMgr of type %s", interceptRuleMgrType)))
+	}
+
+	if err := intMgrCt().Verify(args.Netns, redirect); err != nil {
+		log.Errorf("Redirect rules check failed in netns %s: %v", args.Netns, err)
+		switch {
+		case errors.Is(err, ErrRulesMissing):
+			return applyFailurePolicy(policy, "rule verification",
+				types.NewError(ErrCodeRulesMissing, "redirect rules are missing", err.Error()))
+		case errors.Is(err, ErrRulesDrift):
+			// the programming is atomic, rules that are there but differ are never left by an ignored failure
+			return types.NewError(ErrCodeRulesDrift, "redirect rules have drifted", err.Error())
+		default:
+			return applyFailurePolicy(policy, "rule verification",
+				types.NewError(types.ErrInternal, "failed to verify redirect rules", err.Error()))
+		}
+	}
+
+	log.Infof("Redirect rules verified in netns %s", args.Netns)
+	return nil
 }
 
-// cmdDel is called for pod DELETE requests
-func CmdDel(args *skel.CmdArgs) error {
-	// nothing to cleanup for msm-cni, everything is happening on pod level
+// CmdDel is called for pod DELETE requests
+func CmdDel(args *skel.CmdArgs) (err error) {
+	defer setupLogging(args)()
+	defer recoverPanic("DEL", &err)
+
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		log.Errorf("error parsing msm-cni cmdDel config: %v", err)
+		return err
+	}
+
+	k8sArgs := KubernetesArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		return types.NewError(types.ErrInvalidEnvironmentVariables, "failed to load CNI_ARGS", err.Error())
+	}
+	log.Infof("CmdDel for container %s, netns=%s, args=%s", args.ContainerID, args.Netns, args.Args)
+
+	// in standalone mode the pod interface is released once the redirect is cleaned up
+	if conf.Delegate != nil {
+		defer func() {
+			if err == nil {
+				_, err = delegate(conf, "DEL")
+			}
+		}()
+	}
+
+	// the record goes with the attachment once DEL succeeds
+	attachment := lookupAttachment(conf, args)
+	defer func() {
+		if err == nil {
+			forgetAttachment(conf, args)
+		}
+	}()
+
+	// the runtime may call DEL after the netns is gone, in which case the rules went with it
+	if args.Netns == "" {
+		log.Infof("No netns for container %s, nothing to clean up", args.ContainerID)
+		return nil
+	}
+	if _, err := os.Stat(args.Netns); os.IsNotExist(err) {
+		log.Infof("Netns %s no longer exists, nothing to clean up", args.Netns)
+		return nil
+	}
+
+	// a recorded redirect was programmed whatever the configuration says now
+	if attachment == nil && isExcludedNamespace(conf, string(k8sArgs.K8S_POD_NAMESPACE)) {
+		log.Infof("Pod is excluded from msm-cni")
+		return nil
+	}
+
+	applyPluginConf(conf)
+
+	// the pod may already be gone from the API server, so the rules are removed without
+	// looking at it: the recorded redirect is removed with the backend that programmed it,
+	// and without a record the msm-owned chains are deleted whatever the annotations were,
+	// removing chains that were never added being a no-op.
+	backend := interceptRuleMgrType
+	var redirect *Redirect
+	if attachment != nil {
+		backend = attachment.Backend
+		redirect = redirectFromParams(attachment.Params)
+	} else if redirect, err = NewRedirect(nil, conf.PrevResult); err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid redirect parameters", err.Error())
+	}
+
+	intMgrCt := GetInterceptRuleMgrCtor(backend)
+	if intMgrCt == nil {
+		log.Errorf("Pod redirect cleanup skipped due to unavailable InterceptRuleMgr of type %s", backend)
+		return nil
+	}
+
+	if err := intMgrCt().Cleanup(args.Netns, redirect); err != nil {
+		var netnsErr *NetnsError
+		if errors.As(err, &netnsErr) && netnsErr.NotExist() {
+			log.Infof("Netns %s no longer exists, nothing to clean up", args.Netns)
+			return nil
+		}
+		// without a record the pod may never have been redirected, failing would leave it
+		// terminating with the runtime retrying DEL on a node missing a backend dependency
+		if attachment == nil {
+			log.Warnf("Failed to clean up msm-owned rules in netns %s of an unrecorded pod: %v", args.Netns, err)
+			return nil
+		}
+		log.Errorf("Failed to clean up redirect rules in netns %s: %v", args.Netns, err)
+		return types.NewError(types.ErrInternal, "failed to clean up redirect rules", err.Error())
+	}
+
+	log.Infof("Cleaned up redirect rules in netns %s", args.Netns)
 	return nil
 }
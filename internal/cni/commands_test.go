@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/agent"
+)
+
+const (
+	testPodNamespace = "default"
+	testPodName      = "cam-0"
+	// panickingRuleMgrType is the InterceptRuleMgr of the tests panicking on every call
+	panickingRuleMgrType = "panicking"
+)
+
+// panickingRuleMgr checks that the panics of an InterceptRuleMgr fail the CNI commands
+type panickingRuleMgr struct{}
+
+func (m *panickingRuleMgr) Program(netns string, _ *Redirect) error {
+	panic("Program " + netns)
+}
+
+func (m *panickingRuleMgr) Cleanup(netns string, _ *Redirect) error {
+	panic("Cleanup " + netns)
+}
+
+func (m *panickingRuleMgr) Verify(netns string, _ *Redirect) error {
+	panic("Verify " + netns)
+}
+
+// serveAgent runs the node agent serving the test pod on a Unix socket, and returns the socket path
+func serveAgent(t *testing.T, dir string) string {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        testPodName,
+			Namespace:   testPodNamespace,
+			Annotations: map[string]string{msmSideCarAnnotation: "true"},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Name: "app"}}},
+	}
+	socketPath := filepath.Join(dir, "agent.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.NewServer(fake.NewSimpleClientset(pod), "node-1", socketPath).Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// the agent serves once its caches are synced
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := agent.GetPod(context.Background(), socketPath, testPodNamespace, testPodName)
+		if err == nil {
+			return socketPath
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the agent does not serve on %s: %v", socketPath, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandsReportPanics(t *testing.T) {
+	InterceptRuleMgrTypes[panickingRuleMgrType] = func() InterceptRuleMgr {
+		return &panickingRuleMgr{}
+	}
+	// applyPluginConf sets the package defaults from the configuration
+	previousType := interceptRuleMgrType
+	t.Cleanup(func() {
+		delete(InterceptRuleMgrTypes, panickingRuleMgrType)
+		interceptRuleMgrType = previousType
+	})
+
+	dir := t.TempDir()
+	socketPath := serveAgent(t, dir)
+
+	commands := []struct {
+		name string
+		cmd  func(*skel.CmdArgs) error
+	}{
+		{name: "ADD", cmd: CmdAdd},
+		{name: "CHECK", cmd: CmdCheck},
+		{name: "DEL", cmd: CmdDel},
+	}
+	for _, command := range commands {
+		t.Run(command.name, func(t *testing.T) {
+			logFile := filepath.Join(dir, strings.ToLower(command.name)+".log")
+			conf, err := json.Marshal(map[string]interface{}{
+				"cniVersion": "1.0.0",
+				"name":       "msm",
+				"type":       "msm-cni",
+				"log":        map[string]interface{}{"file": logFile},
+				"stateDir":   filepath.Join(dir, "state"),
+				"kubernetes": map[string]interface{}{
+					"interceptName": panickingRuleMgrType,
+					"agentSocket":   socketPath,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = command.cmd(&skel.CmdArgs{
+				ContainerID: "c1",
+				// the panicking InterceptRuleMgr does not enter the netns, it only has to exist
+				Netns:     "/proc/self/ns/net",
+				IfName:    "eth0",
+				Args:      fmt.Sprintf("IgnoreUnknown=1;K8S_POD_NAMESPACE=%s;K8S_POD_NAME=%s", testPodNamespace, testPodName),
+				StdinData: conf,
+			})
+
+			var cniErr *types.Error
+			if !errors.As(err, &cniErr) {
+				t.Fatalf("%s = %v, want a CNI error", command.name, err)
+			}
+			if cniErr.Code != types.ErrInternal || !strings.Contains(cniErr.Msg, "panicked") {
+				t.Errorf("%s = %+v, want an internal error reporting the panic", command.name, cniErr)
+			}
+
+			logs, err := os.ReadFile(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(logs, []byte("goroutine")) {
+				t.Errorf("the stack of the panic is not in the %s logs:\n%s", command.name, logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	log "github.com/sirupsen/logrus"
+)
+
+// delegate runs a CNI command of the delegate plugin setting up the pod interface in standalone mode.
+// It gets the network configuration of the delegate, with the name and CNI version of msm-cni, its
+// prevResult and the valid attachments of GC. ADD returns the result of the delegate.
+func delegate(conf *PluginConf, command string) (*current.Result, error) {
+	netConf := make(map[string]interface{}, len(conf.Delegate)+3)
+	for key, value := range conf.Delegate {
+		netConf[key] = value
+	}
+	netConf["cniVersion"] = conf.CNIVersion
+	if _, ok := netConf["name"]; !ok {
+		netConf["name"] = conf.Name
+	}
+	if conf.PrevResult != nil {
+		prevResult, err := conf.PrevResult.GetAsVersion(conf.CNIVersion)
+		if err != nil {
+			return nil, types.NewError(types.ErrIncompatibleCNIVersion, "could not convert prevResult for the delegate", err.Error())
+		}
+		netConf["prevResult"] = prevResult
+	}
+	if command == "GC" {
+		netConf["cni.dev/valid-attachments"] = conf.ValidAttachments
+	}
+	data, err := json.Marshal(netConf)
+	if err != nil {
+		return nil, types.NewError(types.ErrInvalidNetworkConfig, "invalid delegate configuration", err.Error())
+	}
+
+	// the type is validated with the configuration
+	pluginType := conf.Delegate["type"].(string)
+	log.Infof("Delegating %s to the %s plugin", command, pluginType)
+
+	ctx := context.Background()
+	var res types.Result
+	switch command {
+	case "ADD":
+		res, err = invoke.DelegateAdd(ctx, pluginType, data, nil)
+	case "CHECK":
+		err = invoke.DelegateCheck(ctx, pluginType, data, nil)
+	case "DEL":
+		err = invoke.DelegateDel(ctx, pluginType, data, nil)
+	case "STATUS":
+		err = invoke.DelegateStatus(ctx, pluginType, data, nil)
+	case "GC":
+		err = invoke.DelegateGC(ctx, pluginType, data, nil)
+	default:
+		return nil, fmt.Errorf("unknown CNI command %s", command)
+	}
+	if err != nil {
+		log.Errorf("Delegate plugin %s failed on %s: %v", pluginType, command, err)
+		// the errors of the delegate are returned as they are
+		var cniErr *types.Error
+		if errors.As(err, &cniErr) {
+			return nil, cniErr
+		}
+		return nil, types.NewError(types.ErrInternal, fmt.Sprintf("delegate plugin %s failed", pluginType), err.Error())
+	}
+	if res == nil {
+		return nil, nil
+	}
+
+	result, err := current.NewResultFromResult(res)
+	if err != nil {
+		return nil, types.NewError(types.ErrIncompatibleCNIVersion, "could not convert the delegate result", err.Error())
+	}
+	return result, nil
+}
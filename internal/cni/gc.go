@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/state"
+)
+
+// CmdGC is called for CNI GC requests, with the attachments of the network that are still valid.
+// The redirect records of the other attachments are removed, with the rules when their netns is
+// still there.
+func CmdGC(args *skel.CmdArgs) (err error) {
+	defer setupLogging(args)()
+	defer recoverPanic("GC", &err)
+
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		log.Errorf("error parsing msm-cni cmdGC config: %v", err)
+		return err
+	}
+
+	valid := make(map[types.GCAttachment]bool, len(conf.ValidAttachments))
+	for _, attachment := range conf.ValidAttachments {
+		valid[attachment] = true
+	}
+	log.Infof("CmdGC with %d valid attachments", len(valid))
+
+	applyPluginConf(conf)
+
+	// the records of the other networks are left to their own GC
+	pruned, err := attachmentStore(conf).Prune(func(a *state.Attachment) bool {
+		return a.Network != conf.Name || valid[types.GCAttachment{ContainerID: a.ContainerID, IfName: a.IfName}]
+	})
+	if err != nil {
+		log.Errorf("Failed to collect the redirect records: %v", err)
+		return types.NewError(types.ErrIOFailure, "failed to collect the redirect records", err.Error())
+	}
+	for _, attachment := range pruned {
+		log.Infof("Collected the redirect of container %s (pod %s/%s)",
+			attachment.ContainerID, attachment.PodNamespace, attachment.PodName)
+		// a leaked sandbox may still have its netns, the rules are removed from it
+		cleanupAttachment(attachment)
+	}
+
+	if conf.Delegate != nil {
+		_, err = delegate(conf, "GC")
+		return err
+	}
+	return nil
+}
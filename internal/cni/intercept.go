@@ -16,20 +16,40 @@
 
 package cni
 
+import "github.com/media-streaming-mesh/msm-cni/internal/rules"
+
 const (
 	defInterceptRuleMgrType = "iptables"
 )
 
+// msm-cni specific CNI error codes, the spec reserves 100 and up for plugins
+const (
+	ErrCodeRulesMissing     uint = 100
+	ErrCodeRulesDrift       uint = 101
+	ErrCodeRulesProgramming uint = 102
+)
+
+var (
+	// ErrRulesMissing is returned by Verify when some of the expected rules are not installed
+	ErrRulesMissing = rules.ErrRulesMissing
+	// ErrRulesDrift is returned by Verify when the rules are installed but not as expected
+	ErrRulesDrift = rules.ErrRulesDrift
+)
+
 // InterceptRuleMgr configures networking tables (e.g. iptables or nftables) for
 // redirecting traffic to an MSM proxy.
 type InterceptRuleMgr interface {
 	Program(netns string, redirect *Redirect) error
+	Cleanup(netns string, redirect *Redirect) error
+	Verify(netns string, redirect *Redirect) error
 }
 
 type InterceptRuleMgrCtor func() InterceptRuleMgr
 
 var InterceptRuleMgrTypes = map[string]InterceptRuleMgrCtor{
-	"iptables": IptablesInterceptRuleMgrCtor,
+	"iptables":     IptablesInterceptRuleMgrCtor,
+	"msm-iptables": NsenterIptablesInterceptRuleMgrCtor,
+	"nftables":     NftablesInterceptRuleMgrCtor,
 }
 
 // Constructor factory for known types of InterceptRuleMgr's
@@ -41,3 +61,13 @@ func GetInterceptRuleMgrCtor(interceptType string) InterceptRuleMgrCtor {
 func IptablesInterceptRuleMgrCtor() InterceptRuleMgr {
 	return newIPTables()
 }
+
+// Constructor for the InterceptRuleMgr running msm-iptables through nsenter
+func NsenterIptablesInterceptRuleMgrCtor() InterceptRuleMgr {
+	return newNsenterIPTables()
+}
+
+// Constructor for nftables InterceptRuleMgr
+func NftablesInterceptRuleMgrCtor() InterceptRuleMgr {
+	return newNFTables()
+}
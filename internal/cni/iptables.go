@@ -17,15 +17,13 @@
 package cni
 
 import (
-	"fmt"
-	"os/exec"
-	"strings"
+	goiptables "github.com/coreos/go-iptables/iptables"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
 )
 
-var nsSetupProg = "msm-iptables"
-
+// iptables programs the rules from within msm-cni, switching into the pod network
+// namespace on a locked OS thread.
 type iptables struct{}
 
 func newIPTables() InterceptRuleMgr {
@@ -33,27 +31,46 @@ func newIPTables() InterceptRuleMgr {
 }
 
 // Program defines a method which programs iptables based on the parameters
-// provided in Redirect.
+// provided in Redirect. The IP families are programmed as one transaction, the
+// netns is left as it was when any rule fails.
 func (ipt *iptables) Program(netns string, rdrct *Redirect) error {
-	netnsArg := fmt.Sprintf("--net=%s", netns)
-	nsSetupExecutable := fmt.Sprintf("%s/%s", nsSetupBinDir, nsSetupProg)
-	nsenterArgs := []string{
-		netnsArg,
-		"--", // separate nsenter args from the rest with `--`, needed for hosts using BusyBox binaries
-		nsSetupExecutable,
-		"-p", rdrct.targetPort,
-		"-u", rdrct.noRedirectUID,
-		"-m", rdrct.redirectMode,
-		"-d", rdrct.noRedirectDestAddr,
-	}
-
-	log.Infof("nsenter args: %s", strings.Join(nsenterArgs, " "))
-	out, err := exec.Command("nsenter", nsenterArgs...).CombinedOutput()
-	if err != nil {
-		log.Errorf("nsenter failed with err: %s, out: %s", err, out)
-		log.Infof("nsenter out: %s", out)
-	} else {
-		log.Infof("nsenter done: %s", out)
-	}
-	return err
+	return inNetns(netns, func() error {
+		handles, err := rules.NewIPTables(rdrct.ruleParams())
+		if err != nil {
+			return err
+		}
+		return rules.ApplyAll(handles, rdrct.ruleParams())
+	})
+}
+
+// Cleanup removes the iptables rules installed by Program for the same Redirect.
+// Rules that are not present are ignored, so it is safe to call more than once.
+func (ipt *iptables) Cleanup(netns string, rdrct *Redirect) error {
+	return ipt.inNetns(netns, rdrct, func(t *goiptables.IPTables) error {
+		return rules.Clean(t, rdrct.ruleParams())
+	})
+}
+
+// Verify checks that the iptables rules installed by Program for the same Redirect
+// are present and in order. It returns ErrRulesMissing or ErrRulesDrift otherwise.
+func (ipt *iptables) Verify(netns string, rdrct *Redirect) error {
+	return ipt.inNetns(netns, rdrct, func(t *goiptables.IPTables) error {
+		return rules.Verify(t, rdrct.ruleParams())
+	})
+}
+
+// inNetns runs f in the pod network namespace for each IP family of the Redirect
+func (ipt *iptables) inNetns(netns string, rdrct *Redirect, f func(t *goiptables.IPTables) error) error {
+	return inNetns(netns, func() error {
+		handles, err := rules.NewIPTables(rdrct.ruleParams())
+		if err != nil {
+			return err
+		}
+		for _, t := range handles {
+			if err := f(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
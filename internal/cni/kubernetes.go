@@ -18,36 +18,78 @@ package cni
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/agent"
 )
 
 var (
-	nsSetupBinDir          = "/opt/cni/bin"
-	interceptRuleMgrType   = defInterceptRuleMgrType
-	podRetrievalMaxRetries = 30
-	podRetrievalInterval   = 1 * time.Second
+	nsSetupBinDir        = "/opt/cni/bin"
+	interceptRuleMgrType = defInterceptRuleMgrType
+	interceptPorts       = []string{defaultRTSPPort}
+	redirectMode         = defaultRedirectMode
+	udpInterceptPorts    []string
+)
+
+// Failure policies, see Kubernetes.FailurePolicy
+const (
+	failurePolicyFail    = "Fail"
+	failurePolicyIgnore  = "Ignore"
+	defaultFailurePolicy = failurePolicyFail
 )
 
-const msmSideCarLabel = "sidecar.mediastreamingmesh.io/inject"
+// msmSideCarLabel enables or disables the redirection to the MSM sidecar on pods and namespaces,
+// the pod annotation with the same key overrides both labels
+const (
+	msmSideCarLabel      = "sidecar.mediastreamingmesh.io/inject"
+	msmSideCarAnnotation = msmSideCarLabel
+)
 
 // Kubernetes a K8s specific struct to hold config
 type Kubernetes struct {
 	K8sAPIRoot           string   `json:"kubernetesAPIRoot"`
 	KubeConfig           string   `json:"kubeConfig"`
 	InterceptRuleMgrType string   `json:"interceptName"`
+	InterceptPorts       []string `json:"interceptPorts"`
+	RedirectMode         string   `json:"redirectMode"`
+	UDPInterceptPorts    []string `json:"udpInterceptPorts"`
 	NodeName             string   `json:"nodeName"`
-	ExcludeNamespaces    []string `json:"excludeNamespaces"`
-	CNIBinDir            string   `json:"cniBinDir"`
+	// IncludeNamespaces and ExcludeNamespaces are glob patterns, see path.Match. When IncludeNamespaces
+	// is set only the pods of the matching namespaces are considered; ExcludeNamespaces wins over it.
+	IncludeNamespaces []string `json:"includeNamespaces"`
+	ExcludeNamespaces []string `json:"excludeNamespaces"`
+	// PodSelector and NamespaceSelector redirect the pods they both match, when set, unless
+	// the sidecar label or annotation says otherwise
+	PodSelector       *metav1.LabelSelector `json:"podSelector"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector"`
+	CNIBinDir         string                `json:"cniBinDir"`
+	// AgentSocket is the Unix socket of the node agent serving pod metadata, the API server is queried when empty
+	AgentSocket string `json:"agentSocket"`
+	// RetryPolicy configures how getting the pod from the API server is retried
+	RetryPolicy RetryPolicy `json:"retryPolicy"`
+	// FailurePolicy is how a failing pod lookup, intercept rule manager or rule programming is handled,
+	// Fail (the default) or Ignore. The first of FailurePolicyOverrides matching the namespace overrides it.
+	FailurePolicy          string                  `json:"failurePolicy"`
+	FailurePolicyOverrides []FailurePolicyOverride `json:"failurePolicyOverrides"`
+}
+
+// FailurePolicyOverride sets the failure policy of the namespaces matching any of its glob patterns
+type FailurePolicyOverride struct {
+	Namespaces    []string `json:"namespaces"`
+	FailurePolicy string   `json:"failurePolicy"`
 }
 
 // PluginConf is the expected json configuration passed in on stdin.
@@ -60,7 +102,13 @@ type PluginConf struct {
 	PrevResult    *current.Result         `json:"-"`
 
 	// Plugin-specific flags
-	LogLevel   string     `json:"logLevel"`
+	LogLevel string    `json:"logLevel"`
+	Log      LogConfig `json:"log"`
+	// Delegate is the network configuration of the plugin msm-cni delegates the pod interface to in
+	// standalone mode, when it is not chained after the plugin setting it up
+	Delegate map[string]interface{} `json:"delegate"`
+	// StateDir is where the redirects programmed on the node are recorded, state.DefaultDir when empty
+	StateDir   string     `json:"stateDir"`
 	Kubernetes Kubernetes `json:"kubernetes"`
 }
 
@@ -81,6 +129,10 @@ type PodInfo struct {
 	Labels            map[string]string
 	Annotations       map[string]string
 	ProxyEnvironments map[string]string
+	// NamespaceLabels are the labels of the pod namespace, nil when it could not be read or the pod decides
+	NamespaceLabels map[string]string
+	// ContainerUIDs are the UIDs the containers run as, for those setting runAsUser
+	ContainerUIDs map[string]string
 }
 
 // newKubeClient returns a Kubernetes client
@@ -111,8 +163,8 @@ func newKubeClient(conf PluginConf) (*kubernetes.Clientset, error) {
 }
 
 // getKubePodInfo returns information of a POD
-func getKubePodInfo(client *kubernetes.Clientset, podName, podNamespace string) (*PodInfo, error) {
-	pod, err := client.CoreV1().Pods(podNamespace).Get(context.TODO(), podName, metav1.GetOptions{})
+func getKubePodInfo(ctx context.Context, client kubernetes.Interface, podName, podNamespace string) (*PodInfo, error) {
+	pod, err := client.CoreV1().Pods(podNamespace).Get(ctx, podName, metav1.GetOptions{})
 	log.Infof("pod info: %+v", pod)
 	if err != nil {
 		log.Infof("could not get pod info: %+v", pod)
@@ -134,6 +186,187 @@ func getKubePodInfo(client *kubernetes.Clientset, podName, podNamespace string)
 		log.Debugf("Inspecting container, pod=%s, container=%s", pod, podName)
 		podInfo.Containers[containerIdx] = container.Name
 	}
+	podInfo.ContainerUIDs = agent.ContainerUIDs(pod)
+
+	// the namespace label only matters when the pod has no say, so it is only read then and
+	// failing to read it is not fatal
+	if !needsNamespaceLabels(podInfo) {
+		return podInfo, nil
+	}
+	namespace, err := client.CoreV1().Namespaces().Get(ctx, podNamespace, metav1.GetOptions{})
+	if err != nil {
+		log.Warnf("could not get namespace %s, its labels are ignored: %v", podNamespace, err)
+	} else {
+		podInfo.NamespaceLabels = namespace.Labels
+	}
 
 	return podInfo, nil
 }
+
+// needsNamespaceLabels reports whether the sidecar injection of the pod depends on the labels of its
+// namespace, i.e. neither its annotation nor its label holds a valid value. The namespace label and
+// the namespaceSelector are only looked at then.
+func needsNamespaceLabels(podInfo *PodInfo) bool {
+	if value, ok := podInfo.Annotations[msmSideCarAnnotation]; ok {
+		if _, valid := parseSideCarInject(value); valid {
+			return false
+		}
+	}
+	if value, ok := podInfo.Labels[msmSideCarLabel]; ok {
+		if _, valid := parseSideCarInject(value); valid {
+			return false
+		}
+	}
+	return true
+}
+
+// getPodInfo retrieves the pod metadata from the node agent when one is configured. Otherwise,
+// or when the agent fails, it creates a kubernetes API client and gets the pod, retrying the
+// transient failures with an exponential backoff until the deadline of the retry policy.
+func getPodInfo(conf *PluginConf, k8sArgs KubernetesArgs) (*PodInfo, error) {
+	// the policy is validated with the configuration
+	policy, err := conf.Kubernetes.RetryPolicy.parse()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), policy.deadline)
+	defer cancel()
+
+	if conf.Kubernetes.AgentSocket != "" {
+		pod, err := agent.GetPod(ctx, conf.Kubernetes.AgentSocket,
+			string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+		if err == nil {
+			log.Infof("Got pod metadata from the node agent")
+			return podInfoFromAgent(pod), nil
+		}
+		log.Warnf("Failed to get pod metadata from the node agent, falling back to the API server, err=%v", err)
+	}
+
+	// create a kubernetes API client
+	client, err := newKubeClient(*conf)
+	if err != nil {
+		log.Errorf("Failed to create kubernetes client, err=%v", err)
+		return nil, err
+	}
+
+	backoff := policy.backoff
+	for attempt := 1; ; attempt++ {
+		podInfo, err := getKubePodInfo(ctx, client, string(k8sArgs.K8S_POD_NAME), string(k8sArgs.K8S_POD_NAMESPACE))
+		if err == nil {
+			return podInfo, nil
+		}
+
+		reason, retriable := classifyError(err)
+		if !retriable {
+			log.Errorf("Failed to get pod data, attempt=%d, reason=%s, not retried, err=%v", attempt, reason, err)
+			return nil, err
+		}
+
+		delay := backoff.Step()
+		if deadline, _ := ctx.Deadline(); time.Now().Add(delay).After(deadline) {
+			log.Errorf("Failed to get pod data, attempt=%d, reason=%s, retry deadline of %s reached, err=%v",
+				attempt, reason, policy.deadline, err)
+			return nil, err
+		}
+		log.Warnf("Failed to get pod data, attempt=%d, reason=%s, retrying in %s, err=%v", attempt, reason, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// podInfoFromAgent converts the pod metadata served by the node agent
+func podInfoFromAgent(pod *agent.Pod) *PodInfo {
+	podInfo := &PodInfo{
+		Containers:        pod.Containers,
+		InitContainers:    make(map[string]struct{}),
+		Labels:            pod.Labels,
+		Annotations:       pod.Annotations,
+		ProxyEnvironments: make(map[string]string),
+		NamespaceLabels:   pod.NamespaceLabels,
+		ContainerUIDs:     pod.ContainerUIDs,
+	}
+	for _, name := range pod.InitContainers {
+		podInfo.InitContainers[name] = struct{}{}
+	}
+	return podInfo
+}
+
+// sideCarInjection decides whether the pod traffic is redirected to the MSM sidecar and returns the
+// reason. The pod annotation overrides the pod label, which overrides the namespace label, which
+// overrides the podSelector and namespaceSelector of the plugin configuration. Pods with none of them
+// are not redirected, invalid values are ignored.
+func sideCarInjection(conf *PluginConf, podInfo *PodInfo) (bool, string) {
+	sources := []struct {
+		kind   string
+		key    string
+		values map[string]string
+	}{
+		{kind: "pod annotation", key: msmSideCarAnnotation, values: podInfo.Annotations},
+		{kind: "pod label", key: msmSideCarLabel, values: podInfo.Labels},
+		{kind: "namespace label", key: msmSideCarLabel, values: podInfo.NamespaceLabels},
+	}
+
+	for _, source := range sources {
+		value, ok := source.values[source.key]
+		if !ok {
+			continue
+		}
+		inject, valid := parseSideCarInject(value)
+		if !valid {
+			log.Warnf("Ignoring %s %s=%q, expected true, false, enabled or disabled", source.kind, source.key, value)
+			continue
+		}
+		return inject, fmt.Sprintf("%s %s=%q", source.kind, source.key, value)
+	}
+
+	if matched, reason := matchSelectors(conf, podInfo); matched {
+		return true, reason
+	}
+	return false, fmt.Sprintf("no valid %s label or annotation", msmSideCarLabel)
+}
+
+// matchSelectors reports whether the pod and its namespace match the selectors of the plugin
+// configuration. Nothing matches when neither is set.
+func matchSelectors(conf *PluginConf, podInfo *PodInfo) (bool, string) {
+	if conf.Kubernetes.PodSelector == nil && conf.Kubernetes.NamespaceSelector == nil {
+		return false, ""
+	}
+
+	var reasons []string
+	for _, sel := range []struct {
+		name     string
+		selector *metav1.LabelSelector
+		labels   map[string]string
+	}{
+		{name: "podSelector", selector: conf.Kubernetes.PodSelector, labels: podInfo.Labels},
+		{name: "namespaceSelector", selector: conf.Kubernetes.NamespaceSelector, labels: podInfo.NamespaceLabels},
+	} {
+		if sel.selector == nil {
+			continue
+		}
+		// the selectors are validated with the configuration
+		selector, err := metav1.LabelSelectorAsSelector(sel.selector)
+		if err != nil || !selector.Matches(labels.Set(sel.labels)) {
+			return false, ""
+		}
+		reasons = append(reasons, fmt.Sprintf("%s %q", sel.name, selector.String()))
+	}
+	return true, "matches " + strings.Join(reasons, " and ")
+}
+
+// parseSideCarInject parses the value of the sidecar label or annotation
+func parseSideCarInject(value string) (inject, valid bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	// the label used to be matched on its key only, so an empty value still enables the sidecar
+	case "", "true", "enabled":
+		return true, true
+	case "false", "disabled":
+		return false, true
+	default:
+		return false, false
+	}
+}
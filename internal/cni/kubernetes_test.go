@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSideCarInjection(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		labels          map[string]string
+		namespaceLabels map[string]string
+		want            bool
+	}{
+		{name: "nothing set", want: false},
+		{name: "pod label", labels: map[string]string{msmSideCarLabel: "true"}, want: true},
+		{name: "empty pod label", labels: map[string]string{msmSideCarLabel: ""}, want: true},
+		{name: "pod label disabled", labels: map[string]string{msmSideCarLabel: "Disabled"}, want: false},
+		{name: "namespace label", namespaceLabels: map[string]string{msmSideCarLabel: "enabled"}, want: true},
+		{
+			name:            "pod label over namespace label",
+			labels:          map[string]string{msmSideCarLabel: "false"},
+			namespaceLabels: map[string]string{msmSideCarLabel: "true"},
+			want:            false,
+		},
+		{
+			name:        "annotation over pod label",
+			annotations: map[string]string{msmSideCarAnnotation: "true"},
+			labels:      map[string]string{msmSideCarLabel: "false"},
+			want:        true,
+		},
+		{
+			name:            "invalid pod label ignored",
+			labels:          map[string]string{msmSideCarLabel: "yes"},
+			namespaceLabels: map[string]string{msmSideCarLabel: "true"},
+			want:            true,
+		},
+		{name: "invalid pod label only", labels: map[string]string{msmSideCarLabel: "yes"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podInfo := &PodInfo{Annotations: tt.annotations, Labels: tt.labels, NamespaceLabels: tt.namespaceLabels}
+			if got, reason := sideCarInjection(&PluginConf{}, podInfo); got != tt.want {
+				t.Errorf("sideCarInjection() = %v (%s), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetKubePodInfoNamespace(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   testPodNamespace,
+		Labels: map[string]string{msmSideCarLabel: "true"},
+	}}
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		labels        map[string]string
+		wantNamespace bool
+	}{
+		{name: "nothing set", wantNamespace: true},
+		{name: "pod annotation", annotations: map[string]string{msmSideCarAnnotation: "false"}, wantNamespace: false},
+		{name: "pod label", labels: map[string]string{msmSideCarLabel: "true"}, wantNamespace: false},
+		{name: "invalid pod label", labels: map[string]string{msmSideCarLabel: "yes"}, wantNamespace: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        testPodName,
+				Namespace:   testPodNamespace,
+				Annotations: tt.annotations,
+				Labels:      tt.labels,
+			}}
+			client := fake.NewSimpleClientset(pod, namespace)
+
+			podInfo, err := getKubePodInfo(context.Background(), client, testPodName, testPodNamespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gets := 0
+			for _, action := range client.Actions() {
+				if action.GetResource().Resource == "namespaces" {
+					gets++
+				}
+			}
+			wantGets := 0
+			if tt.wantNamespace {
+				wantGets = 1
+			}
+			if gets != wantGets || (podInfo.NamespaceLabels != nil) != tt.wantNamespace {
+				t.Errorf("getKubePodInfo() read the namespace %d times, labels %v, want %d", gets, podInfo.NamespaceLabels, wantGets)
+			}
+		})
+	}
+}
+
+func TestMatchSelectors(t *testing.T) {
+	media := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "media"}}
+	streaming := &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"streaming", "edge"}},
+	}}
+
+	tests := []struct {
+		name              string
+		podSelector       *metav1.LabelSelector
+		namespaceSelector *metav1.LabelSelector
+		labels            map[string]string
+		namespaceLabels   map[string]string
+		want              bool
+	}{
+		{name: "no selectors", labels: map[string]string{"app": "media"}, want: false},
+		{name: "pod selector", podSelector: media, labels: map[string]string{"app": "media"}, want: true},
+		{name: "pod selector mismatch", podSelector: media, labels: map[string]string{"app": "web"}, want: false},
+		{
+			name:              "namespace selector",
+			namespaceSelector: streaming,
+			namespaceLabels:   map[string]string{"tier": "edge"},
+			want:              true,
+		},
+		{
+			name:              "both selectors",
+			podSelector:       media,
+			namespaceSelector: streaming,
+			labels:            map[string]string{"app": "media"},
+			namespaceLabels:   map[string]string{"tier": "streaming"},
+			want:              true,
+		},
+		{
+			name:              "namespace selector mismatch",
+			podSelector:       media,
+			namespaceSelector: streaming,
+			labels:            map[string]string{"app": "media"},
+			namespaceLabels:   map[string]string{"tier": "backend"},
+			want:              false,
+		},
+		{
+			name:              "unknown namespace labels",
+			namespaceSelector: streaming,
+			want:              false,
+		},
+		{name: "empty selector", podSelector: &metav1.LabelSelector{}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &PluginConf{}
+			conf.Kubernetes.PodSelector = tt.podSelector
+			conf.Kubernetes.NamespaceSelector = tt.namespaceSelector
+			podInfo := &PodInfo{Labels: tt.labels, NamespaceLabels: tt.namespaceLabels}
+			if got, reason := matchSelectors(conf, podInfo); got != tt.want {
+				t.Errorf("matchSelectors() = %v (%s), want %v", got, reason, tt.want)
+			}
+			// the sidecar label wins over the selectors
+			podInfo.Labels = map[string]string{msmSideCarLabel: "false"}
+			for k, v := range tt.labels {
+				podInfo.Labels[k] = v
+			}
+			if got, _ := sideCarInjection(conf, podInfo); got {
+				t.Errorf("sideCarInjection() = true with the sidecar label disabled")
+			}
+		})
+	}
+}
+
+func TestIsExcludedNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		namespace string
+		want      bool
+	}{
+		{name: "no patterns", namespace: "default", want: false},
+		{name: "excluded", exclude: []string{"kube-*"}, namespace: "kube-system", want: true},
+		{name: "not excluded", exclude: []string{"kube-*"}, namespace: "media", want: false},
+		{name: "included", include: []string{"media-?", "broadcast"}, namespace: "media-1", want: false},
+		{name: "not included", include: []string{"media-?", "broadcast"}, namespace: "media-10", want: true},
+		{
+			name:      "excluded over included",
+			include:   []string{"media-*"},
+			exclude:   []string{"media-test"},
+			namespace: "media-test",
+			want:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &PluginConf{}
+			conf.Kubernetes.IncludeNamespaces = tt.include
+			conf.Kubernetes.ExcludeNamespaces = tt.exclude
+			if got := isExcludedNamespace(conf, tt.namespace); got != tt.want {
+				t.Errorf("isExcludedNamespace(%q) = %v, want %v", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	overrides := []FailurePolicyOverride{
+		{Namespaces: []string{"media-*", "broadcast"}, FailurePolicy: failurePolicyFail},
+		{Namespaces: []string{"media-test", "dev-?"}, FailurePolicy: failurePolicyIgnore},
+	}
+
+	tests := []struct {
+		name      string
+		policy    string
+		overrides []FailurePolicyOverride
+		namespace string
+		want      string
+	}{
+		{name: "default", namespace: "media-1", want: defaultFailurePolicy},
+		{name: "configured", policy: failurePolicyIgnore, namespace: "media-1", want: failurePolicyIgnore},
+		{name: "exact match", policy: failurePolicyIgnore, overrides: overrides, namespace: "broadcast", want: failurePolicyFail},
+		{name: "glob match", policy: failurePolicyIgnore, overrides: overrides, namespace: "media-1", want: failurePolicyFail},
+		{name: "first match wins", overrides: overrides, namespace: "media-test", want: failurePolicyFail},
+		{name: "later match", overrides: overrides, namespace: "dev-1", want: failurePolicyIgnore},
+		{name: "glob mismatch", overrides: overrides, namespace: "dev-10", want: defaultFailurePolicy},
+		{name: "configured fallback", policy: failurePolicyIgnore, overrides: overrides, namespace: "web", want: failurePolicyIgnore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &PluginConf{}
+			conf.Kubernetes.FailurePolicy = tt.policy
+			conf.Kubernetes.FailurePolicyOverrides = tt.overrides
+			if got := failurePolicy(conf, tt.namespace); got != tt.want {
+				t.Errorf("failurePolicy(%q) = %s, want %s", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/agent"
+)
+
+// Log defaults and formats, see LogConfig
+const (
+	defaultLogFile       = "/var/log/msm-cni.log"
+	defaultLogMaxSize    = 10
+	defaultLogMaxBackups = 3
+	logFormatJSON        = "json"
+	logFormatText        = "text"
+	defaultLogFormat     = logFormatText
+)
+
+// LogConfig configures the plugin logs, the level is PluginConf.LogLevel
+type LogConfig struct {
+	// File is rotated when it grows over MaxSize megabytes, MaxBackups rotated files are kept
+	File       string `json:"file"`
+	MaxSize    int    `json:"maxSize"`
+	MaxBackups int    `json:"maxBackups"`
+	// Format is json or text
+	Format string `json:"format"`
+	// ToAgent also sends the logs to the node agent at Kubernetes.AgentSocket
+	ToAgent bool `json:"toAgent"`
+}
+
+// validate checks the values set in the plugin configuration
+func (c LogConfig) validate(level string) error {
+	if level != "" {
+		if _, err := log.ParseLevel(level); err != nil {
+			return fmt.Errorf("invalid logLevel %s", level)
+		}
+	}
+	switch c.Format {
+	case "", logFormatJSON, logFormatText:
+	default:
+		return fmt.Errorf("invalid log format %s, expected %s or %s", c.Format, logFormatJSON, logFormatText)
+	}
+	if c.MaxSize < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("log maxSize and maxBackups cannot be negative")
+	}
+	return nil
+}
+
+// withDefaults returns the configuration with the defaults for the values not set
+func (c LogConfig) withDefaults() LogConfig {
+	if c.File == "" {
+		c.File = defaultLogFile
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultLogMaxSize
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = defaultLogMaxBackups
+	}
+	if c.Format == "" {
+		c.Format = defaultLogFormat
+	}
+	return c
+}
+
+// fieldsHook adds the identity of the pod to every log line
+type fieldsHook struct {
+	fields log.Fields
+}
+
+func (h *fieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *fieldsHook) Fire(entry *log.Entry) error {
+	for key, value := range h.fields {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
+
+// setupLogging points the logger at the plugin log file configured in the plugin configuration and
+// returns a func closing it, and sending the logs to the node agent when configured
+func setupLogging(args *skel.CmdArgs) func() {
+	// the configuration is validated by parseConfig, the logs are set up with what can be read of it
+	var conf struct {
+		LogLevel   string    `json:"logLevel"`
+		Log        LogConfig `json:"log"`
+		Kubernetes struct {
+			AgentSocket string `json:"agentSocket"`
+		} `json:"kubernetes"`
+	}
+	_ = json.Unmarshal(args.StdinData, &conf)
+	k8sArgs := KubernetesArgs{}
+	_ = types.LoadArgs(args.Args, &k8sArgs)
+	logConf := conf.Log.withDefaults()
+
+	level, err := log.ParseLevel(conf.LogLevel)
+	if err != nil {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+	if logConf.Format == logFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+	}
+
+	// STATUS and GC are not about a container
+	fields := log.Fields{}
+	if args.ContainerID != "" {
+		fields["containerID"] = args.ContainerID
+	}
+	if name := string(k8sArgs.K8S_POD_NAME); name != "" {
+		fields["pod"] = name
+	}
+	if namespace := string(k8sArgs.K8S_POD_NAMESPACE); namespace != "" {
+		fields["namespace"] = namespace
+	}
+	hooks := make(log.LevelHooks)
+	hooks.Add(&fieldsHook{fields: fields})
+	log.StandardLogger().ReplaceHooks(hooks)
+
+	// stdout carries the CNI result, the logs go to stderr when the file cannot be opened
+	var out io.Writer = os.Stderr
+	f, err := openLogFile(logConf.File, logConf.MaxSize, logConf.MaxBackups)
+	if err == nil {
+		out = f
+	}
+	var agentLogs bytes.Buffer
+	toAgent := logConf.ToAgent && conf.Kubernetes.AgentSocket != ""
+	if toAgent {
+		out = io.MultiWriter(out, &agentLogs)
+	}
+	log.SetOutput(out)
+	if err != nil {
+		log.Warnf("Failed to open the log file %s, logging to stderr: %v", logConf.File, err)
+	}
+
+	return func() {
+		if toAgent && agentLogs.Len() > 0 {
+			if err := agent.SendLogs(context.Background(), conf.Kubernetes.AgentSocket, agentLogs.Bytes()); err != nil {
+				log.Warnf("Failed to send the logs to the agent at %s: %v", conf.Kubernetes.AgentSocket, err)
+			}
+		}
+		log.SetOutput(os.Stderr)
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+}
+
+// openLogFile opens file for appending, rotating it first when it has grown over maxSize megabytes:
+// file.1 is the most recent rotated file and file.<maxBackups> the oldest. The concurrent plugin runs
+// rotate it one at a time, holding the lock of file.lock.
+func openLogFile(file string, maxSize, maxBackups int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// closing the file releases the lock
+	defer lock.Close()
+
+	for {
+		err = unix.Flock(int(lock.Fd()), unix.LOCK_EX)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %v", file, err)
+	}
+
+	// the file was not rotated by another run while waiting for the lock when it is still too big
+	if info, err := os.Stat(file); err == nil && info.Size() >= int64(maxSize)<<20 {
+		for i := maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", file, i), fmt.Sprintf("%s.%d", file, i+1))
+		}
+		_ = os.Rename(file, file+".1")
+	}
+
+	// the logs hold pod metadata, only root reads them
+	return os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenLogFileRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "msm-cni.log")
+	full := bytes.Repeat([]byte("x"), 1<<20)
+	for name, data := range map[string][]byte{file: full, file + ".1": []byte("1"), file + ".2": []byte("2")} {
+		if err := os.WriteFile(name, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another plugin run holds the lock, the rotation waits for it
+	lock, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		f, err := openLogFile(file, 1, 2)
+		if err == nil {
+			err = f.Close()
+		}
+		opened <- err
+	}()
+
+	select {
+	case err := <-opened:
+		t.Fatalf("openLogFile() = %v while the lock is held", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if data, err := os.ReadFile(file); err != nil || !bytes.Equal(data, full) {
+		t.Fatalf("%s was rotated while the lock is held", file)
+	}
+
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+
+	// file.1 is the most recent rotated file, the oldest beyond maxBackups is dropped
+	for name, want := range map[string][]byte{file: {}, file + ".1": full, file + ".2": []byte("1")} {
+		if data, err := os.ReadFile(name); err != nil || !bytes.Equal(data, want) {
+			t.Errorf("%s holds %d bytes (%v), want %d", name, len(data), err, len(want))
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists beyond maxBackups", file)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// NetnsError reports a failure to enter the pod network namespace
+type NetnsError struct {
+	Path string
+	Err  error
+}
+
+func (e *NetnsError) Error() string {
+	return fmt.Sprintf("failed to enter netns %s: %v", e.Path, e.Err)
+}
+
+func (e *NetnsError) Unwrap() error {
+	return e.Err
+}
+
+// NotExist reports whether the netns is already gone
+func (e *NetnsError) NotExist() bool {
+	var notExistErr ns.NSPathNotExistErr
+	return errors.As(e.Err, &notExistErr)
+}
+
+// inNetns runs f on an OS thread locked into the network namespace at netnsPath.
+// Processes started by f run in that namespace as well.
+func inNetns(netnsPath string, f func() error) error {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return &NetnsError{Path: netnsPath, Err: err}
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		return f()
+	})
+}
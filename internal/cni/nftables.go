@@ -0,0 +1,559 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	goiptables "github.com/coreos/go-iptables/iptables"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
+)
+
+var nftProg = "nft"
+
+// nftErrLineRe finds the failing line of the nft input in its errors
+var nftErrLineRe = regexp.MustCompile(`/dev/stdin:(\d+):`)
+
+// The msm-owned table, nothing else in the pod netns is touched. The inet
+// family holds the rules of both IPv4 and IPv6.
+const (
+	nftTableFamily = "inet"
+	nftTableName   = "msm"
+	// the table used to be IPv4 only, it is removed along with the current one
+	nftLegacyTableFamily = "ip"
+)
+
+// nftFamily holds the keywords of an IP family in nft rules
+type nftFamily struct {
+	proto     goiptables.Protocol
+	nfproto   string
+	addr      string
+	localAddr string
+}
+
+var (
+	nftIPv4 = nftFamily{proto: goiptables.ProtocolIPv4, nfproto: "ipv4", addr: "ip", localAddr: "127.0.0.1"}
+	nftIPv6 = nftFamily{proto: goiptables.ProtocolIPv6, nfproto: "ipv6", addr: "ip6", localAddr: "[::1]"}
+)
+
+// nftRule is a single rule of an msm chain. The comment identifies the
+// rule when listing the chain back.
+type nftRule struct {
+	expr    string
+	comment string
+}
+
+// nftChain is a base chain of the msm table
+type nftChain struct {
+	name  string
+	hook  string
+	rules []nftRule
+}
+
+type nftables struct{}
+
+func newNFTables() InterceptRuleMgr {
+	return &nftables{}
+}
+
+// Program defines a method which programs an msm nftables table based on the
+// parameters provided in Redirect. An existing msm table is replaced in a single
+// nft transaction, and restored when setting up the TPROXY policy routing fails.
+func (nft *nftables) Program(netns string, rdrct *Redirect) error {
+	chains, err := nft.chains(rdrct)
+	if err != nil {
+		return err
+	}
+
+	// lines holds the rule programmed by each line of the script, keyed by line number
+	lines := map[int]rules.RuleError{}
+	var b strings.Builder
+	b.WriteString(nft.deleteTablesScript())
+	fmt.Fprintf(&b, "table %s %s {\n", nftTableFamily, nftTableName)
+	for _, chain := range chains {
+		fmt.Fprintf(&b, "\tchain %s {\n", chain.name)
+		fmt.Fprintf(&b, "\t\t%s; policy accept;\n", chain.hook)
+		for _, rule := range chain.rules {
+			lines[strings.Count(b.String(), "\n")+1] = rules.RuleError{
+				Table: nftTableFamily + " " + nftTableName, Chain: chain.name, RuleSpec: strings.Fields(rule.expr),
+			}
+			fmt.Fprintf(&b, "\t\t%s comment %q\n", rule.expr, rule.comment)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+
+	previous, err := nft.snapshot(netns)
+	if err != nil {
+		return err
+	}
+
+	if _, err = nft.run(netns, b.String(), "-f", "-"); err != nil {
+		// nft points at the failing line of its input, e.g. `/dev/stdin:12:3-40: Error: ...`
+		if match := nftErrLineRe.FindStringSubmatch(err.Error()); match != nil {
+			if n, _ := strconv.Atoi(match[1]); lines[n].Chain != "" {
+				ruleErr := lines[n]
+				ruleErr.Op = "add"
+				ruleErr.Err = err
+				return &ruleErr
+			}
+		}
+		return err
+	}
+
+	params := rdrct.ruleParams()
+	if !params.NeedsTProxyRouting() {
+		return nil
+	}
+	err = inNetns(netns, func() error {
+		// like rules.Snapshot, the routing of the families that had none is removed again on failure
+		var added []goiptables.Protocol
+		for _, proto := range params.Protocols() {
+			// a failing family may be left with its route but not its rule
+			if rules.VerifyTProxyRouting(params, proto) != nil {
+				added = append(added, proto)
+			}
+			if err := rules.AddTProxyRouting(params, proto); err != nil {
+				var rbErrs []error
+				for _, proto := range added {
+					if rbErr := rules.DelTProxyRouting(params, proto); rbErr != nil {
+						rbErrs = append(rbErrs, rbErr)
+					}
+				}
+				if rbErr := errors.Join(rbErrs...); rbErr != nil {
+					return fmt.Errorf("%w (removing the TPROXY policy routing failed: %v)", err, rbErr)
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if _, rbErr := nft.run(netns, nft.deleteTablesScript()+previous, "-f", "-"); rbErr != nil {
+			return fmt.Errorf("%w (restoring the previous msm table failed: %v)", err, rbErr)
+		}
+	}
+	return err
+}
+
+// snapshot returns the current msm table as an nft script, empty when there is none
+func (nft *nftables) snapshot(netns string) (string, error) {
+	out, err := nft.run(netns, "", "list", "table", nftTableFamily, nftTableName)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// listing only fails when the table does not exist
+		return "", nil
+	}
+	return out, err
+}
+
+// Cleanup removes the msm nftables table and the TPROXY policy routing.
+// It is a no-op when they do not exist.
+func (nft *nftables) Cleanup(netns string, rdrct *Redirect) error {
+	if _, err := nft.run(netns, nft.deleteTablesScript(), "-f", "-"); err != nil {
+		return err
+	}
+
+	// the policy routing is removed for both families, the pod IPs may not be known on cleanup
+	params := rdrct.ruleParams()
+	return inNetns(netns, func() error {
+		for _, proto := range []goiptables.Protocol{goiptables.ProtocolIPv4, goiptables.ProtocolIPv6} {
+			if err := rules.DelTProxyRouting(params, proto); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Verify checks that the msm table holds exactly the chains of the Redirect, with their hooks and
+// rules in order. It returns ErrRulesMissing or ErrRulesDrift otherwise.
+func (nft *nftables) Verify(netns string, rdrct *Redirect) error {
+	chains, err := nft.chains(rdrct)
+	if err != nil {
+		return err
+	}
+
+	out, err := nft.run(netns, "", "list", "table", nftTableFamily, nftTableName)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// listing only fails when the table does not exist
+		return fmt.Errorf("%w: %v", ErrRulesMissing, err)
+	} else if err != nil {
+		return err
+	}
+
+	listed := parseNftTable(out)
+	for _, chain := range chains {
+		installed, ok := listed[chain.name]
+		if !ok {
+			return fmt.Errorf("%w: chain %s not found", ErrRulesMissing, chain.name)
+		}
+		delete(listed, chain.name)
+		if hook := normalizeNftHook(installed.hook); hook != chain.hook {
+			return fmt.Errorf("%w: chain %s is %q, expected %q", ErrRulesDrift, chain.name, installed.hook, chain.hook)
+		}
+		if err := verifyNftRules(chain, installed.rules); err != nil {
+			return err
+		}
+	}
+	if len(listed) > 0 {
+		names := make([]string, 0, len(listed))
+		for name := range listed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("%w: unexpected chains %s", ErrRulesDrift, strings.Join(names, ", "))
+	}
+
+	params := rdrct.ruleParams()
+	if !params.NeedsTProxyRouting() {
+		return nil
+	}
+	return inNetns(netns, func() error {
+		for _, proto := range params.Protocols() {
+			if err := rules.VerifyTProxyRouting(params, proto); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// verifyNftRules checks that the listed rules of the chain are exactly its rules, in order
+func verifyNftRules(chain nftChain, listed []nftRule) error {
+	expected := map[string]bool{}
+	for _, rule := range chain.rules {
+		expected[rule.comment] = true
+	}
+
+	pos := 0
+	for _, rule := range chain.rules {
+		if pos < len(listed) && listed[pos] == rule {
+			pos++
+			continue
+		}
+		if pos < len(listed) && !expected[listed[pos].comment] {
+			break
+		}
+		found := false
+		for _, l := range listed {
+			if l.comment != rule.comment {
+				continue
+			}
+			found = true
+			if l.expr != rule.expr {
+				return fmt.Errorf("%w: rule %q is %q, expected %q", ErrRulesDrift, rule.comment, l.expr, rule.expr)
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: rule %q not found in chain %s", ErrRulesMissing, rule.comment, chain.name)
+		}
+		return fmt.Errorf("%w: rule %q is out of order in chain %s", ErrRulesDrift, rule.comment, chain.name)
+	}
+	if pos != len(listed) {
+		return fmt.Errorf("%w: unexpected rule %q in chain %s", ErrRulesDrift, listed[pos].expr, chain.name)
+	}
+	return nil
+}
+
+// parseNftTable returns the chains of an `nft list table` output, keyed by name. The hook holds the
+// `type ... hook ... priority ...` statement of the chain, the rules without a comment have an empty one.
+func parseNftTable(out string) map[string]*nftChain {
+	chains := map[string]*nftChain{}
+	var chain *nftChain
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "table "):
+		case line == "}":
+			chain = nil
+		case strings.HasPrefix(line, "chain "):
+			name := strings.TrimSuffix(strings.TrimPrefix(line, "chain "), " {")
+			chain = &nftChain{name: name}
+			chains[name] = chain
+		case chain == nil:
+		case strings.HasPrefix(line, "type "):
+			chain.hook, _, _ = strings.Cut(line, ";")
+		default:
+			expr, comment, _ := strings.Cut(line, " comment ")
+			chain.rules = append(chain.rules, nftRule{expr: expr, comment: strings.Trim(comment, `"`)})
+		}
+	}
+	return chains
+}
+
+// nftPriorities are the standard chain priorities nft lists by name
+var nftPriorities = map[string]int{
+	"raw":      -300,
+	"mangle":   -150,
+	"dstnat":   -100,
+	"filter":   0,
+	"security": 50,
+	"srcnat":   100,
+}
+
+// normalizeNftHook returns the `type ... hook ... priority ...` statement of a chain with a numeric
+// priority, the way the chains are programmed. It is returned as is when it cannot be parsed.
+func normalizeNftHook(hook string) string {
+	fields := strings.Fields(hook)
+	if len(fields) < 6 || fields[0] != "type" || fields[2] != "hook" || fields[4] != "priority" {
+		return hook
+	}
+
+	// the priority is a number, a standard name, or a standard name plus or minus a number
+	expr := fields[5:]
+	priority, err := strconv.Atoi(expr[0])
+	if err != nil {
+		var ok bool
+		if priority, ok = nftPriorities[expr[0]]; !ok {
+			return hook
+		}
+	}
+	if len(expr) == 3 {
+		offset, err := strconv.Atoi(expr[2])
+		switch {
+		case err != nil:
+			return hook
+		case expr[1] == "+":
+			priority += offset
+		case expr[1] == "-":
+			priority -= offset
+		default:
+			return hook
+		}
+	} else if len(expr) != 1 {
+		return hook
+	}
+	return fmt.Sprintf("type %s hook %s priority %d", fields[1], fields[3], priority)
+}
+
+// chains returns the chains of the msm table, with the same semantics as msm-iptables
+func (nft *nftables) chains(rdrct *Redirect) ([]nftChain, error) {
+	if err := rules.Validate(rdrct.ruleParams()); err != nil {
+		return nil, err
+	}
+	families := nft.families(rdrct)
+
+	output := nftChain{
+		name:  "output",
+		hook:  "type nat hook output priority -100",
+		rules: nft.exemptionRules(rdrct, families, "tcp"),
+	}
+	for _, port := range rdrct.interceptPorts {
+		output.rules = append(output.rules, nftRule{
+			expr:    fmt.Sprintf("tcp dport %s redirect to :%s", port, rdrct.targetPort),
+			comment: "msm-redirect-" + port,
+		})
+	}
+	chains := []nftChain{output}
+	if inbound, ok := nft.inboundChain(rdrct, families); ok {
+		chains = append(chains, inbound)
+	}
+	if rdrct.redirectMode != redirectModeTPROXY {
+		return chains, nil
+	}
+
+	// locally generated UDP packets are marked on output, delivered back through lo
+	// by the policy routing and handed to the proxy on prerouting
+	mark := fmt.Sprintf("0x%08x", rules.TProxyMark)
+	mangleOutput := nftChain{
+		name:  "mangle_output",
+		hook:  "type route hook output priority -150",
+		rules: nft.exemptionRules(rdrct, families, "udp"),
+	}
+	for _, port := range rdrct.udpInterceptPorts {
+		mangleOutput.rules = append(mangleOutput.rules, nftRule{
+			expr:    fmt.Sprintf("udp dport %s meta mark set %s", port, mark),
+			comment: "msm-mark-" + port,
+		})
+	}
+
+	tproxyPort := rdrct.tproxyPort
+	if tproxyPort == "" {
+		tproxyPort = rdrct.targetPort
+	}
+	manglePrerouting := nftChain{
+		name: "mangle_prerouting",
+		hook: "type filter hook prerouting priority -150",
+	}
+	for _, fam := range families {
+		manglePrerouting.rules = append(manglePrerouting.rules, nftRule{
+			expr: fmt.Sprintf(`meta nfproto %s iifname "lo" meta l4proto udp meta mark %s tproxy %s to %s:%s`,
+				fam.nfproto, mark, fam.addr, fam.localAddr, tproxyPort),
+			comment: "msm-tproxy-" + fam.nfproto,
+		})
+	}
+
+	return append(chains, mangleOutput, manglePrerouting), nil
+}
+
+// inboundChain returns the prerouting chain intercepting the inbound traffic, if any
+func (nft *nftables) inboundChain(rdrct *Redirect, families []nftFamily) (nftChain, bool) {
+	if len(rdrct.inboundPorts) == 0 {
+		return nftChain{}, false
+	}
+
+	chain := nftChain{
+		name: "prerouting",
+		hook: "type nat hook prerouting priority -100",
+	}
+	tproxy := rdrct.inboundInterceptMode == redirectModeTPROXY
+	if tproxy {
+		chain = nftChain{
+			name: "inbound_tproxy",
+			hook: "type filter hook prerouting priority -150",
+			rules: []nftRule{{
+				expr:    `iifname "lo" return`,
+				comment: "msm-inbound-lo",
+			}},
+		}
+	}
+
+	for _, port := range rdrct.inboundExcludePorts {
+		chain.rules = append(chain.rules, nftRule{
+			expr:    fmt.Sprintf("tcp dport %s return", port),
+			comment: "msm-inbound-exclude-" + port,
+		})
+	}
+	for _, port := range rdrct.inboundPorts {
+		match := fmt.Sprintf("tcp dport %s", port)
+		if port == rules.AllPorts {
+			match = "meta l4proto tcp"
+		}
+		if !tproxy {
+			chain.rules = append(chain.rules, nftRule{
+				expr:    fmt.Sprintf("%s redirect to :%s", match, rdrct.inboundProxyPort),
+				comment: "msm-inbound-" + port,
+			})
+			continue
+		}
+		// the tproxy statement is family specific in an inet table
+		for _, fam := range families {
+			chain.rules = append(chain.rules, nftRule{
+				expr: fmt.Sprintf("meta nfproto %s %s meta mark set 0x%08x tproxy %s to :%s",
+					fam.nfproto, match, rules.TProxyMark, fam.addr, rdrct.inboundProxyPort),
+				comment: "msm-inbound-" + port + "-" + fam.nfproto,
+			})
+		}
+	}
+	return chain, true
+}
+
+// exemptionRules returns the rules exempting traffic from the redirection
+func (nft *nftables) exemptionRules(rdrct *Redirect, families []nftFamily, proto string) []nftRule {
+	var nftRules []nftRule
+	for _, fam := range families {
+		loopback := rdrct.noRedirectDestAddr
+		if fam.proto == goiptables.ProtocolIPv6 {
+			loopback = rules.IPv6LoopbackCIDR
+		}
+		nftRules = append(nftRules, nftRule{
+			expr:    fmt.Sprintf("%s daddr %s return", fam.addr, nftAddr(loopback)),
+			comment: "msm-no-redirect-dest-" + fam.nfproto,
+		})
+		for _, cidr := range rules.CIDRsOf(rdrct.excludeCIDRs, fam.proto) {
+			nftRules = append(nftRules, nftRule{
+				expr:    fmt.Sprintf("%s daddr %s return", fam.addr, nftAddr(cidr)),
+				comment: "msm-exclude-" + cidr,
+			})
+		}
+	}
+	nftRules = append(nftRules, nftRule{
+		expr:    fmt.Sprintf("meta l4proto %s meta skuid %s return", proto, rdrct.noRedirectUID),
+		comment: "msm-no-redirect-uid",
+	})
+	for _, uid := range rdrct.excludeUIDs {
+		nftRules = append(nftRules, nftRule{
+			expr:    fmt.Sprintf("meta l4proto %s meta skuid %s return", proto, uid),
+			comment: "msm-exclude-uid-" + uid,
+		})
+	}
+	for _, gid := range rdrct.excludeGIDs {
+		nftRules = append(nftRules, nftRule{
+			expr:    fmt.Sprintf("meta l4proto %s meta skgid %s return", proto, gid),
+			comment: "msm-exclude-gid-" + gid,
+		})
+	}
+	return nftRules
+}
+
+// families returns the IP families the rules are programmed for
+func (nft *nftables) families(rdrct *Redirect) []nftFamily {
+	var families []nftFamily
+	for _, proto := range rdrct.ruleParams().Protocols() {
+		if proto == goiptables.ProtocolIPv6 {
+			families = append(families, nftIPv6)
+		} else {
+			families = append(families, nftIPv4)
+		}
+	}
+	return families
+}
+
+// deleteTablesScript returns the nft commands deleting the msm tables. Adding
+// a table first makes its delete a no-op when it does not exist yet.
+func (nft *nftables) deleteTablesScript() string {
+	var b strings.Builder
+	for _, family := range []string{nftLegacyTableFamily, nftTableFamily} {
+		fmt.Fprintf(&b, "add table %[1]s %[2]s\ndelete table %[1]s %[2]s\n", family, nftTableName)
+	}
+	return b.String()
+}
+
+// nftAddr returns a CIDR the way nft lists it, as a bare address when it is a single host
+func nftAddr(cidr string) string {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return cidr
+	}
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String()
+	}
+	return ipNet.String()
+}
+
+// run executes nft inside the pod network namespace, feeding it stdin when not empty
+func (nft *nftables) run(netns, stdin string, nftArgs ...string) (out string, err error) {
+	err = inNetns(netns, func() error {
+		log.Infof("nft args: %s", strings.Join(nftArgs, " "))
+		cmd := exec.Command(nftProg, nftArgs...)
+		if stdin != "" {
+			log.Debugf("nft input:\n%s", stdin)
+			cmd.Stdin = strings.NewReader(stdin)
+		}
+
+		combined, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Errorf("nft failed with err: %s, out: %s", err, combined)
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(combined)))
+		}
+		log.Infof("nft done: %s", combined)
+		out = string(combined)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeNftHook(t *testing.T) {
+	tests := []struct {
+		hook string
+		want string
+	}{
+		{"type nat hook output priority -100", "type nat hook output priority -100"},
+		{"type nat hook prerouting priority dstnat", "type nat hook prerouting priority -100"},
+		{"type route hook output priority mangle", "type route hook output priority -150"},
+		{"type filter hook prerouting priority mangle + 10", "type filter hook prerouting priority -140"},
+		{"type filter hook prerouting priority filter - 5", "type filter hook prerouting priority -5"},
+		{"type filter hook prerouting priority unknown", "type filter hook prerouting priority unknown"},
+		{"type filter hook prerouting", "type filter hook prerouting"},
+	}
+	for _, tt := range tests {
+		if got := normalizeNftHook(tt.hook); got != tt.want {
+			t.Errorf("normalizeNftHook(%q) = %q, want %q", tt.hook, got, tt.want)
+		}
+	}
+}
+
+// nftListing renders the chains the way `nft list table` prints them
+func nftListing(chains []nftChain) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table %s %s {\n", nftTableFamily, nftTableName)
+	for _, chain := range chains {
+		fmt.Fprintf(&b, "\tchain %s {\n\t\t%s; policy accept;\n", chain.name, chain.hook)
+		for _, rule := range chain.rules {
+			if rule.comment == "" {
+				fmt.Fprintf(&b, "\t\t%s\n", rule.expr)
+				continue
+			}
+			fmt.Fprintf(&b, "\t\t%s comment %q\n", rule.expr, rule.comment)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func TestVerifyNftRules(t *testing.T) {
+	redirect, err := NewRedirect(&PodInfo{Annotations: map[string]string{
+		interceptPortsAnnotation: "554,8000-8010",
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := (&nftables{}).chains(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := expected[0]
+
+	tests := []struct {
+		name  string
+		rules func([]nftRule) []nftRule
+		want  error
+	}{
+		{
+			name:  "same rules",
+			rules: func(r []nftRule) []nftRule { return r },
+		},
+		{
+			name:  "missing rule",
+			rules: func(r []nftRule) []nftRule { return r[:len(r)-1] },
+			want:  ErrRulesMissing,
+		},
+		{
+			name: "changed rule",
+			rules: func(r []nftRule) []nftRule {
+				r[len(r)-1].expr = "tcp dport 554 redirect to :9000"
+				return r
+			},
+			want: ErrRulesDrift,
+		},
+		{
+			name: "out of order",
+			rules: func(r []nftRule) []nftRule {
+				r[0], r[1] = r[1], r[0]
+				return r
+			},
+			want: ErrRulesDrift,
+		},
+		{
+			name: "uncommented rule",
+			rules: func(r []nftRule) []nftRule {
+				return append([]nftRule{{expr: "tcp dport 80 redirect to :9000"}}, r...)
+			},
+			want: ErrRulesDrift,
+		},
+		{
+			name: "extra rule",
+			rules: func(r []nftRule) []nftRule {
+				return append(r, nftRule{expr: "tcp dport 80 redirect to :9000", comment: "msm-redirect-80"})
+			},
+			want: ErrRulesDrift,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := output
+			chain.rules = tt.rules(append([]nftRule{}, output.rules...))
+			listed := parseNftTable(nftListing([]nftChain{chain}))[output.name]
+			if listed == nil {
+				t.Fatalf("chain %s not parsed", output.name)
+			}
+			err := verifyNftRules(output, listed.rules)
+			if tt.want == nil && err != nil {
+				t.Fatalf("verifyNftRules() = %v, want nil", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("verifyNftRules() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNftTable(t *testing.T) {
+	listing := `table inet msm {
+	chain output {
+		type nat hook output priority -100; policy accept;
+		ip daddr 127.0.0.0/8 return comment "msm-no-redirect-dest-ipv4"
+		tcp dport 80 return
+	}
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+	}
+}
+`
+	chains := parseNftTable(listing)
+	if len(chains) != 2 {
+		t.Fatalf("got %d chains, want 2", len(chains))
+	}
+	output := chains["output"]
+	if output.hook != "type nat hook output priority -100" {
+		t.Errorf("output hook = %q", output.hook)
+	}
+	want := []nftRule{
+		{expr: "ip daddr 127.0.0.0/8 return", comment: "msm-no-redirect-dest-ipv4"},
+		{expr: "tcp dport 80 return"},
+	}
+	if len(output.rules) != len(want) || output.rules[0] != want[0] || output.rules[1] != want[1] {
+		t.Errorf("output rules = %v, want %v", output.rules, want)
+	}
+	if hook := normalizeNftHook(chains["prerouting"].hook); hook != "type nat hook prerouting priority -100" {
+		t.Errorf("prerouting hook = %q", hook)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var nsSetupProg = "msm-iptables"
+
+// Exit codes of msm-iptables verify, kept in sync with util/msm-iptables
+const (
+	nsSetupExitRulesMissing = 2
+	nsSetupExitRulesDrift   = 3
+)
+
+// nsenterIPTables programs the rules by running the msm-iptables executable in the
+// pod network namespace through the host's nsenter.
+type nsenterIPTables struct{}
+
+func newNsenterIPTables() InterceptRuleMgr {
+	return &nsenterIPTables{}
+}
+
+// Program defines a method which programs iptables based on the parameters
+// provided in Redirect.
+func (ipt *nsenterIPTables) Program(netns string, rdrct *Redirect) error {
+	return ipt.nsSetup(netns, rdrct, "apply")
+}
+
+// Cleanup removes the iptables rules installed by Program for the same Redirect.
+// Rules that are not present are ignored, so it is safe to call more than once.
+func (ipt *nsenterIPTables) Cleanup(netns string, rdrct *Redirect) error {
+	return ipt.nsSetup(netns, rdrct, "clean")
+}
+
+// Verify checks that the iptables rules installed by Program for the same Redirect
+// are present and in order. It returns ErrRulesMissing or ErrRulesDrift otherwise.
+func (ipt *nsenterIPTables) Verify(netns string, rdrct *Redirect) error {
+	err := ipt.nsSetup(netns, rdrct, "verify")
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case nsSetupExitRulesMissing:
+			return fmt.Errorf("%w: %v", ErrRulesMissing, err)
+		case nsSetupExitRulesDrift:
+			return fmt.Errorf("%w: %v", ErrRulesDrift, err)
+		}
+	}
+	return err
+}
+
+// nsSetup runs an msm-iptables subcommand inside the pod network namespace.
+func (ipt *nsenterIPTables) nsSetup(netns string, rdrct *Redirect, subcommand string) error {
+	netnsArg := fmt.Sprintf("--net=%s", netns)
+	nsSetupExecutable := fmt.Sprintf("%s/%s", nsSetupBinDir, nsSetupProg)
+	nsenterArgs := []string{
+		netnsArg,
+		"--", // separate nsenter args from the rest with `--`, needed for hosts using BusyBox binaries
+		nsSetupExecutable,
+		subcommand,
+		"-p", rdrct.targetPort,
+		"-u", rdrct.noRedirectUID,
+		"-m", rdrct.inboundInterceptMode,
+		"-d", rdrct.noRedirectDestAddr,
+	}
+	if len(rdrct.ipFamilies) > 0 {
+		nsenterArgs = append(nsenterArgs, "--ip-families", strings.Join(rdrct.ipFamilies, ","))
+	}
+	if len(rdrct.excludeCIDRs) > 0 {
+		nsenterArgs = append(nsenterArgs, "--exclude-cidrs", strings.Join(rdrct.excludeCIDRs, ","))
+	}
+	if len(rdrct.excludeUIDs) > 0 {
+		nsenterArgs = append(nsenterArgs, "--exclude-uids", strings.Join(rdrct.excludeUIDs, ","))
+	}
+	if len(rdrct.excludeGIDs) > 0 {
+		nsenterArgs = append(nsenterArgs, "--exclude-gids", strings.Join(rdrct.excludeGIDs, ","))
+	}
+	if len(rdrct.interceptPorts) > 0 {
+		nsenterArgs = append(nsenterArgs, "--intercept-ports", strings.Join(rdrct.interceptPorts, ","))
+	}
+	if len(rdrct.inboundPorts) > 0 {
+		nsenterArgs = append(nsenterArgs, "--inbound-ports", strings.Join(rdrct.inboundPorts, ","),
+			"--inbound-proxy-port", rdrct.inboundProxyPort)
+		if len(rdrct.inboundExcludePorts) > 0 {
+			nsenterArgs = append(nsenterArgs, "--inbound-exclude-ports", strings.Join(rdrct.inboundExcludePorts, ","))
+		}
+	}
+	if rdrct.redirectMode == redirectModeTPROXY {
+		nsenterArgs = append(nsenterArgs, "--redirect-mode", rdrct.redirectMode,
+			"--udp-intercept-ports", strings.Join(rdrct.udpInterceptPorts, ","))
+		if rdrct.tproxyPort != "" {
+			nsenterArgs = append(nsenterArgs, "--tproxy-port", rdrct.tproxyPort)
+		}
+	}
+
+	log.Infof("nsenter args: %s", strings.Join(nsenterArgs, " "))
+	out, err := exec.Command("nsenter", nsenterArgs...).CombinedOutput()
+	if err != nil {
+		log.Errorf("nsenter failed with err: %s, out: %s", err, out)
+		log.Infof("nsenter out: %s", out)
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Infof("nsenter done: %s", out)
+	return nil
+}
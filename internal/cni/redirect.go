@@ -17,12 +17,46 @@
 // Defines the redirect object and operations.
 package cni
 
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
+)
+
 const (
-	redirectModeREDIRECT      = "REDIRECT"
+	redirectModeREDIRECT      = rules.RedirectModeREDIRECT
+	redirectModeTPROXY        = rules.RedirectModeTPROXY
 	defaultRedirectToPort     = "8554"
+	defaultRTSPPort           = rules.RTSPPort
 	defaultRedirectMode       = redirectModeREDIRECT
 	defaultNoRedirectUID      = "1337"
 	defaultNoRedirectDestAddr = "127.0.0.0/8"
+	defaultInboundProxyPort   = "8555"
+)
+
+// Pod annotations overriding the redirect defaults
+const (
+	proxyPortAnnotation      = "redirect.mediastreamingmesh.io/proxy-port"
+	proxyUIDAnnotation       = "redirect.mediastreamingmesh.io/proxy-uid"
+	excludeCIDRsAnnotation   = "redirect.mediastreamingmesh.io/exclude-cidrs"
+	interceptPortsAnnotation = "redirect.mediastreamingmesh.io/intercept-ports"
+	redirectModeAnnotation   = "redirect.mediastreamingmesh.io/redirect-mode"
+	udpPortsAnnotation       = "redirect.mediastreamingmesh.io/udp-intercept-ports"
+	tproxyPortAnnotation     = "redirect.mediastreamingmesh.io/tproxy-port"
+
+	excludeUIDsAnnotation = "redirect.mediastreamingmesh.io/exclude-uids"
+	excludeGIDsAnnotation = "redirect.mediastreamingmesh.io/exclude-gids"
+	// excludeContainersAnnotation exempts the traffic of containers by name, through their runAsUser
+	excludeContainersAnnotation = "redirect.mediastreamingmesh.io/exclude-containers"
+
+	inboundModeAnnotation         = "redirect.mediastreamingmesh.io/inbound-intercept-mode"
+	inboundPortsAnnotation        = "redirect.mediastreamingmesh.io/inbound-intercept-ports"
+	inboundExcludePortsAnnotation = "redirect.mediastreamingmesh.io/inbound-exclude-ports"
+	inboundProxyPortAnnotation    = "redirect.mediastreamingmesh.io/inbound-proxy-port"
 )
 
 // Redirect is the msm-cni redirect object
@@ -31,16 +65,294 @@ type Redirect struct {
 	redirectMode       string
 	noRedirectUID      string
 	noRedirectDestAddr string
+	excludeCIDRs       []string
+	excludeUIDs        []string
+	excludeGIDs        []string
+	interceptPorts     []string
+	udpInterceptPorts  []string
+	tproxyPort         string
+
+	inboundInterceptMode string
+	inboundPorts         []string
+	inboundExcludePorts  []string
+	inboundProxyPort     string
+
+	ipFamilies []string
 }
 
-// NewRedirect returns a new Redirect Object constructed from a list of ports and annotations
-// For now we are using some default values but that can change in the future to support
-// passing values through annotations
-func NewRedirect(_ *PodInfo) (*Redirect, error) {
-	return &Redirect{
+// NewRedirect returns a new Redirect Object constructed from the pod annotations.
+// Values that are not annotated fall back to the defaults and the plugin configuration,
+// and a nil pod gets those only. The rules are programmed for the IP families of the
+// pod IPs in prevResult, IPv4 only when there is none.
+func NewRedirect(pi *PodInfo, prevResult *current.Result) (*Redirect, error) {
+	redirect := &Redirect{
 		targetPort:         defaultRedirectToPort,
-		redirectMode:       defaultRedirectMode,
+		redirectMode:       redirectMode,
 		noRedirectUID:      defaultNoRedirectUID,
 		noRedirectDestAddr: defaultNoRedirectDestAddr,
-	}, nil
+		interceptPorts:     interceptPorts,
+		udpInterceptPorts:  udpInterceptPorts,
+
+		inboundInterceptMode: defaultRedirectMode,
+		inboundProxyPort:     defaultInboundProxyPort,
+
+		ipFamilies: podIPFamilies(prevResult),
+	}
+	if pi == nil {
+		return redirect, nil
+	}
+
+	if value, ok := pi.Annotations[proxyPortAnnotation]; ok {
+		if err := rules.ValidatePort(value); err != nil {
+			return nil, annotationError(proxyPortAnnotation, value, err)
+		}
+		redirect.targetPort = value
+	}
+
+	if value, ok := pi.Annotations[proxyUIDAnnotation]; ok {
+		if err := rules.ValidateID(value); err != nil {
+			return nil, annotationError(proxyUIDAnnotation, value, err)
+		}
+		redirect.noRedirectUID = value
+	}
+
+	if value, ok := pi.Annotations[excludeCIDRsAnnotation]; ok {
+		for _, cidr := range splitList(value) {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, annotationError(excludeCIDRsAnnotation, value, err)
+			}
+			redirect.excludeCIDRs = append(redirect.excludeCIDRs, ipNet.String())
+		}
+	}
+
+	if value, ok := pi.Annotations[excludeUIDsAnnotation]; ok {
+		ids, err := parseIDList(excludeUIDsAnnotation, value)
+		if err != nil {
+			return nil, err
+		}
+		redirect.excludeUIDs = ids
+	}
+
+	if value, ok := pi.Annotations[excludeGIDsAnnotation]; ok {
+		ids, err := parseIDList(excludeGIDsAnnotation, value)
+		if err != nil {
+			return nil, err
+		}
+		redirect.excludeGIDs = ids
+	}
+
+	if value, ok := pi.Annotations[excludeContainersAnnotation]; ok {
+		for _, name := range splitList(value) {
+			uid, ok := pi.ContainerUIDs[name]
+			if !ok {
+				return nil, annotationError(excludeContainersAnnotation, value,
+					fmt.Errorf("container %s is not in the pod or does not set runAsUser", name))
+			}
+			if !contains(redirect.excludeUIDs, uid) {
+				redirect.excludeUIDs = append(redirect.excludeUIDs, uid)
+			}
+		}
+	}
+
+	if value, ok := pi.Annotations[interceptPortsAnnotation]; ok {
+		ports, err := parsePortList(interceptPortsAnnotation, value)
+		if err != nil {
+			return nil, err
+		}
+		redirect.interceptPorts = ports
+	}
+
+	if value, ok := pi.Annotations[redirectModeAnnotation]; ok {
+		mode, err := parseRedirectMode(redirectModeAnnotation, value)
+		if err != nil {
+			return nil, err
+		}
+		redirect.redirectMode = mode
+	}
+
+	if value, ok := pi.Annotations[udpPortsAnnotation]; ok {
+		ports, err := parsePortList(udpPortsAnnotation, value)
+		if err != nil {
+			return nil, err
+		}
+		redirect.udpInterceptPorts = ports
+	}
+
+	if value, ok := pi.Annotations[tproxyPortAnnotation]; ok {
+		if err := rules.ValidatePort(value); err != nil {
+			return nil, annotationError(tproxyPortAnnotation, value, err)
+		}
+		redirect.tproxyPort = value
+	}
+
+	if value, ok := pi.Annotations[inboundModeAnnotation]; ok {
+		mode, err := parseRedirectMode(inboundModeAnnotation, value)
+		if err != nil {
+			return nil, err
+		}
+		redirect.inboundInterceptMode = mode
+	}
+
+	if value, ok := pi.Annotations[inboundPortsAnnotation]; ok {
+		if strings.TrimSpace(value) == rules.AllPorts {
+			redirect.inboundPorts = []string{rules.AllPorts}
+		} else {
+			ports, err := parsePortList(inboundPortsAnnotation, value)
+			if err != nil {
+				return nil, err
+			}
+			redirect.inboundPorts = ports
+		}
+	}
+
+	if value, ok := pi.Annotations[inboundExcludePortsAnnotation]; ok {
+		ports, err := parsePortList(inboundExcludePortsAnnotation, value)
+		if err != nil {
+			return nil, err
+		}
+		redirect.inboundExcludePorts = ports
+	}
+
+	if value, ok := pi.Annotations[inboundProxyPortAnnotation]; ok {
+		if err := rules.ValidatePort(value); err != nil {
+			return nil, annotationError(inboundProxyPortAnnotation, value, err)
+		}
+		redirect.inboundProxyPort = value
+	}
+
+	if err := rules.Validate(redirect.ruleParams()); err != nil {
+		return nil, fmt.Errorf("invalid redirect for pod: %v", err)
+	}
+
+	return redirect, nil
+}
+
+// redirectFromParams returns the Redirect the rules were built from, see ruleParams
+func redirectFromParams(p rules.Params) *Redirect {
+	return &Redirect{
+		targetPort:         p.ProxyPort,
+		noRedirectUID:      p.ProxyUID,
+		noRedirectDestAddr: p.NoRedirectDestAddr,
+		excludeCIDRs:       p.ExcludeCIDRs,
+		excludeUIDs:        p.ExcludeUIDs,
+		excludeGIDs:        p.ExcludeGIDs,
+		ipFamilies:         p.IPFamilies,
+		interceptPorts:     p.InterceptPorts,
+		redirectMode:       p.RedirectMode,
+		udpInterceptPorts:  p.UDPInterceptPorts,
+		tproxyPort:         p.TProxyPort,
+
+		inboundInterceptMode: p.InboundInterceptMode,
+		inboundPorts:         p.InboundPorts,
+		inboundExcludePorts:  p.InboundExcludePorts,
+		inboundProxyPort:     p.InboundProxyPort,
+	}
+}
+
+// ruleParams returns the parameters the redirect rules are built from
+func (r *Redirect) ruleParams() rules.Params {
+	return rules.Params{
+		ProxyPort:          r.targetPort,
+		ProxyUID:           r.noRedirectUID,
+		NoRedirectDestAddr: r.noRedirectDestAddr,
+		ExcludeCIDRs:       r.excludeCIDRs,
+		ExcludeUIDs:        r.excludeUIDs,
+		ExcludeGIDs:        r.excludeGIDs,
+		IPFamilies:         r.ipFamilies,
+		InterceptPorts:     r.interceptPorts,
+		RedirectMode:       r.redirectMode,
+		UDPInterceptPorts:  r.udpInterceptPorts,
+		TProxyPort:         r.tproxyPort,
+
+		InboundInterceptMode: r.inboundInterceptMode,
+		InboundPorts:         r.inboundPorts,
+		InboundExcludePorts:  r.inboundExcludePorts,
+		InboundProxyPort:     r.inboundProxyPort,
+	}
+}
+
+func annotationError(annotation, value string, err error) error {
+	return fmt.Errorf("invalid value %q for annotation %s: %v", value, annotation, err)
+}
+
+// splitList splits a comma separated annotation value, ignoring empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parsePortList parses a comma separated list of ports and port ranges from an annotation value
+func parsePortList(annotation, value string) ([]string, error) {
+	ports := splitList(value)
+	if len(ports) == 0 {
+		return nil, annotationError(annotation, value, fmt.Errorf("no ports listed"))
+	}
+	for _, port := range ports {
+		if err := rules.ValidatePortRange(port); err != nil {
+			return nil, annotationError(annotation, value, err)
+		}
+	}
+	return ports, nil
+}
+
+// parseIDList parses a comma separated list of UIDs or GIDs
+func parseIDList(annotation, value string) ([]string, error) {
+	ids := splitList(value)
+	for _, id := range ids {
+		if err := rules.ValidateID(id); err != nil {
+			return nil, annotationError(annotation, value, err)
+		}
+	}
+	return ids, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRedirectMode parses a REDIRECT or TPROXY mode from an annotation value
+func parseRedirectMode(annotation, value string) (string, error) {
+	switch mode := strings.ToUpper(value); mode {
+	case redirectModeREDIRECT, redirectModeTPROXY:
+		return mode, nil
+	default:
+		return "", annotationError(annotation, value,
+			fmt.Errorf("must be %s or %s", redirectModeREDIRECT, redirectModeTPROXY))
+	}
+}
+
+// podIPFamilies returns the IP families of the pod IPs in prevResult
+func podIPFamilies(prevResult *current.Result) []string {
+	if prevResult == nil {
+		return []string{rules.IPv4}
+	}
+
+	var hasIPv4, hasIPv6 bool
+	for _, ipConfig := range prevResult.IPs {
+		if ipConfig.Address.IP.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+
+	var families []string
+	if hasIPv4 || !hasIPv6 {
+		families = append(families, rules.IPv4)
+	}
+	if hasIPv6 {
+		families = append(families, rules.IPv6)
+	}
+	return families
 }
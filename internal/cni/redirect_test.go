@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
+)
+
+func TestNewRedirect(t *testing.T) {
+	defaults := rules.Params{
+		ProxyPort:            defaultRedirectToPort,
+		ProxyUID:             defaultNoRedirectUID,
+		NoRedirectDestAddr:   defaultNoRedirectDestAddr,
+		IPFamilies:           []string{rules.IPv4},
+		InterceptPorts:       interceptPorts,
+		RedirectMode:         redirectMode,
+		InboundInterceptMode: defaultRedirectMode,
+		InboundProxyPort:     defaultInboundProxyPort,
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		uids        map[string]string
+		want        func(p *rules.Params)
+		wantErr     bool
+	}{
+		{
+			name: "no annotations",
+			want: func(p *rules.Params) {},
+		},
+		{
+			name: "proxy",
+			annotations: map[string]string{
+				proxyPortAnnotation: "9554",
+				proxyUIDAnnotation:  "1500",
+			},
+			want: func(p *rules.Params) {
+				p.ProxyPort = "9554"
+				p.ProxyUID = "1500"
+			},
+		},
+		{
+			name:        "invalid proxy port",
+			annotations: map[string]string{proxyPortAnnotation: "0"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid proxy UID",
+			annotations: map[string]string{proxyUIDAnnotation: "proxy"},
+			wantErr:     true,
+		},
+		{
+			name:        "exclude CIDRs",
+			annotations: map[string]string{excludeCIDRsAnnotation: "10.1.2.3/8, fd00::1/8"},
+			want:        func(p *rules.Params) { p.ExcludeCIDRs = []string{"10.0.0.0/8", "fd00::/8"} },
+		},
+		{
+			name:        "invalid CIDR",
+			annotations: map[string]string{excludeCIDRsAnnotation: "10.0.0.0"},
+			wantErr:     true,
+		},
+		{
+			name:        "intercept ports",
+			annotations: map[string]string{interceptPortsAnnotation: "554, 8000-8010,"},
+			want:        func(p *rules.Params) { p.InterceptPorts = []string{"554", "8000-8010"} },
+		},
+		{
+			name:        "empty intercept ports",
+			annotations: map[string]string{interceptPortsAnnotation: " , "},
+			wantErr:     true,
+		},
+		{
+			name:        "reversed port range",
+			annotations: map[string]string{interceptPortsAnnotation: "8010-8000"},
+			wantErr:     true,
+		},
+		{
+			name: "TPROXY",
+			annotations: map[string]string{
+				redirectModeAnnotation: "tproxy",
+				udpPortsAnnotation:     "20000-30000",
+				tproxyPortAnnotation:   "8556",
+			},
+			want: func(p *rules.Params) {
+				p.RedirectMode = redirectModeTPROXY
+				p.UDPInterceptPorts = []string{"20000-30000"}
+				p.TProxyPort = "8556"
+			},
+		},
+		{
+			name:        "TPROXY without UDP ports",
+			annotations: map[string]string{redirectModeAnnotation: "TPROXY"},
+			wantErr:     true,
+		},
+		{
+			name:        "unknown redirect mode",
+			annotations: map[string]string{redirectModeAnnotation: "DNAT"},
+			wantErr:     true,
+		},
+		{
+			name: "all inbound ports",
+			annotations: map[string]string{
+				inboundPortsAnnotation:        " * ",
+				inboundExcludePortsAnnotation: "22",
+				inboundProxyPortAnnotation:    "9555",
+			},
+			want: func(p *rules.Params) {
+				p.InboundPorts = []string{rules.AllPorts}
+				p.InboundExcludePorts = []string{"22"}
+				p.InboundProxyPort = "9555"
+			},
+		},
+		{
+			name:        "invalid inbound mode",
+			annotations: map[string]string{inboundModeAnnotation: "NAT"},
+			wantErr:     true,
+		},
+		{
+			name: "excluded UIDs, GIDs and containers",
+			annotations: map[string]string{
+				excludeUIDsAnnotation:       "1500,1600",
+				excludeGIDsAnnotation:       "2000",
+				excludeContainersAnnotation: "helper,sidecar",
+			},
+			uids: map[string]string{"helper": "1600", "sidecar": "1700"},
+			want: func(p *rules.Params) {
+				p.ExcludeUIDs = []string{"1500", "1600", "1700"}
+				p.ExcludeGIDs = []string{"2000"}
+			},
+		},
+		{
+			name:        "invalid excluded GID",
+			annotations: map[string]string{excludeGIDsAnnotation: "-1"},
+			wantErr:     true,
+		},
+		{
+			name:        "excluded container without runAsUser",
+			annotations: map[string]string{excludeContainersAnnotation: "helper"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redirect, err := NewRedirect(&PodInfo{Annotations: tt.annotations, ContainerUIDs: tt.uids}, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NewRedirect() = %+v, want an error", redirect.ruleParams())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewRedirect() = %v", err)
+			}
+			want := defaults
+			tt.want(&want)
+			if got := redirect.ruleParams(); !reflect.DeepEqual(got, want) {
+				t.Errorf("NewRedirect() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPodIPFamilies(t *testing.T) {
+	result := func(ips ...string) *current.Result {
+		res := &current.Result{}
+		for _, ip := range ips {
+			res.IPs = append(res.IPs, &current.IPConfig{Address: net.IPNet{IP: net.ParseIP(ip)}})
+		}
+		return res
+	}
+
+	tests := []struct {
+		name   string
+		result *current.Result
+		want   []string
+	}{
+		{"no prevResult", nil, []string{rules.IPv4}},
+		{"no IPs", result(), []string{rules.IPv4}},
+		{"IPv4", result("10.0.0.5"), []string{rules.IPv4}},
+		{"IPv6", result("fd00::5"), []string{rules.IPv6}},
+		{"dual-stack", result("fd00::5", "10.0.0.5"), []string{rules.IPv4, rules.IPv6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podIPFamilies(tt.result); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podIPFamilies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
+)
+
+// resultKey is the key of the CNI result the redirect of the pod is recorded under
+const resultKey = "msm"
+
+// RedirectResult records the redirect programmed for a pod in the CNI result printed by ADD. It is
+// informational, the runtimes going through libcni drop it, the state store is the record CHECK and DEL use.
+type RedirectResult struct {
+	// Backend is the InterceptRuleMgr type that programmed the rules
+	Backend           string   `json:"backend"`
+	RedirectMode      string   `json:"redirectMode"`
+	ProxyPort         string   `json:"proxyPort"`
+	TProxyPort        string   `json:"tproxyPort,omitempty"`
+	InboundProxyPort  string   `json:"inboundProxyPort,omitempty"`
+	InterceptPorts    []string `json:"interceptPorts"`
+	UDPInterceptPorts []string `json:"udpInterceptPorts,omitempty"`
+	InboundPorts      []string `json:"inboundPorts,omitempty"`
+	ExcludeUIDs       []string `json:"excludeUIDs,omitempty"`
+	ExcludeGIDs       []string `json:"excludeGIDs,omitempty"`
+	IPFamilies        []string `json:"ipFamilies"`
+	// RuleHash identifies the rules, it changes with the backend or any of the redirect parameters
+	RuleHash string `json:"ruleHash"`
+}
+
+// newRedirectResult returns the record of a redirect programmed by the backend
+func newRedirectResult(backend string, r *Redirect) *RedirectResult {
+	res := &RedirectResult{
+		Backend:           backend,
+		RedirectMode:      r.redirectMode,
+		ProxyPort:         r.targetPort,
+		InterceptPorts:    r.interceptPorts,
+		UDPInterceptPorts: r.udpInterceptPorts,
+		ExcludeUIDs:       r.excludeUIDs,
+		ExcludeGIDs:       r.excludeGIDs,
+		IPFamilies:        r.ipFamilies,
+		RuleHash:          ruleHash(backend, r),
+	}
+	if len(res.IPFamilies) == 0 {
+		res.IPFamilies = []string{rules.IPv4}
+	}
+	if r.redirectMode == redirectModeTPROXY {
+		res.TProxyPort = r.tproxyPort
+		if res.TProxyPort == "" {
+			res.TProxyPort = r.targetPort
+		}
+	}
+	if len(r.inboundPorts) > 0 {
+		res.InboundPorts = r.inboundPorts
+		res.InboundProxyPort = r.inboundProxyPort
+	}
+	return res
+}
+
+// ruleHash returns the hash of the rules programmed by the backend for a redirect
+func ruleHash(backend string, r *Redirect) string {
+	// the params only hold strings and slices, they always marshal
+	data, _ := json.Marshal(struct {
+		Backend string
+		Params  rules.Params
+	}{backend, r.ruleParams()})
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// printResult prints the result in the requested version, with the redirect recorded under resultKey
+func printResult(result *current.Result, redirect *RedirectResult, cniVersion string) error {
+	if redirect == nil {
+		return types.PrintResult(result, cniVersion)
+	}
+
+	versioned, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(versioned)
+	if err != nil {
+		return err
+	}
+	out := map[string]interface{}{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	out[resultKey] = redirect
+
+	data, err = json.MarshalIndent(out, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
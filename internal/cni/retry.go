@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Defaults of the pod retrieval retry policy: about a dozen attempts within the deadline
+const (
+	defaultRetryInitialInterval = 250 * time.Millisecond
+	defaultRetryMaxInterval     = 4 * time.Second
+	defaultRetryMultiplier      = 2.0
+	defaultRetryJitter          = 0.2
+	defaultRetryDeadline        = 30 * time.Second
+)
+
+// RetryPolicy configures how retrieving the pod metadata from the API server is retried.
+// The durations are Go duration strings, e.g. "500ms", and unset values fall back to the defaults.
+type RetryPolicy struct {
+	// InitialInterval is the wait before the first retry
+	InitialInterval string `json:"initialInterval"`
+	// MaxInterval caps the wait between two attempts
+	MaxInterval string `json:"maxInterval"`
+	// Multiplier grows the wait after every retry
+	Multiplier float64 `json:"multiplier"`
+	// Jitter adds up to this fraction of the wait to it, randomly
+	Jitter float64 `json:"jitter"`
+	// Deadline bounds the retrieval as a whole, attempts included
+	Deadline string `json:"deadline"`
+}
+
+// retryPolicy is a RetryPolicy with its defaults applied
+type retryPolicy struct {
+	backoff  wait.Backoff
+	deadline time.Duration
+}
+
+// parse validates the policy and applies the defaults
+func (r RetryPolicy) parse() (retryPolicy, error) {
+	policy := retryPolicy{
+		backoff: wait.Backoff{
+			Duration: defaultRetryInitialInterval,
+			Cap:      defaultRetryMaxInterval,
+			Factor:   defaultRetryMultiplier,
+			Jitter:   defaultRetryJitter,
+			// the deadline ends the retries, not a number of steps
+			Steps: math.MaxInt32,
+		},
+		deadline: defaultRetryDeadline,
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{name: "initialInterval", value: r.InitialInterval, dst: &policy.backoff.Duration},
+		{name: "maxInterval", value: r.MaxInterval, dst: &policy.backoff.Cap},
+		{name: "deadline", value: r.Deadline, dst: &policy.deadline},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration <= 0 {
+			return retryPolicy{}, fmt.Errorf("invalid retryPolicy %s %q, expected a positive duration", d.name, d.value)
+		}
+		*d.dst = duration
+	}
+
+	if r.Multiplier != 0 {
+		if r.Multiplier < 1 {
+			return retryPolicy{}, fmt.Errorf("invalid retryPolicy multiplier %v, expected 1 or more", r.Multiplier)
+		}
+		policy.backoff.Factor = r.Multiplier
+	}
+	if r.Jitter != 0 {
+		if r.Jitter < 0 || r.Jitter > 1 {
+			return retryPolicy{}, fmt.Errorf("invalid retryPolicy jitter %v, expected between 0 and 1", r.Jitter)
+		}
+		policy.backoff.Jitter = r.Jitter
+	}
+	return policy, nil
+}
+
+// classifyError returns why retrieving the pod failed and whether trying again may succeed
+func classifyError(err error) (reason string, retriable bool) {
+	var netErr net.Error
+	switch {
+	case apierrors.IsNotFound(err):
+		// the pod may not be visible yet right after it is scheduled
+		return "NotFound", true
+	case apierrors.IsForbidden(err):
+		return "Forbidden", false
+	case apierrors.IsUnauthorized(err):
+		return "Unauthorized", false
+	case apierrors.IsBadRequest(err), apierrors.IsInvalid(err), apierrors.IsMethodNotSupported(err):
+		return "BadRequest", false
+	case apierrors.IsTooManyRequests(err):
+		return "TooManyRequests", true
+	case apierrors.IsServiceUnavailable(err), apierrors.IsServerTimeout(err), apierrors.IsTimeout(err),
+		apierrors.IsInternalError(err):
+		return "Unavailable", true
+	case errors.As(err, &netErr):
+		return "Unavailable", true
+	default:
+		return "Unknown", true
+	}
+}
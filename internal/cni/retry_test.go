@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRetryPolicyParse(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       RetryPolicy
+		wantInitial  time.Duration
+		wantMax      time.Duration
+		wantFactor   float64
+		wantJitter   float64
+		wantDeadline time.Duration
+		wantErr      bool
+	}{
+		{
+			name:         "defaults",
+			wantInitial:  defaultRetryInitialInterval,
+			wantMax:      defaultRetryMaxInterval,
+			wantFactor:   defaultRetryMultiplier,
+			wantJitter:   defaultRetryJitter,
+			wantDeadline: defaultRetryDeadline,
+		},
+		{
+			name: "all set",
+			policy: RetryPolicy{
+				InitialInterval: "100ms",
+				MaxInterval:     "1s",
+				Multiplier:      1.5,
+				Jitter:          0.5,
+				Deadline:        "10s",
+			},
+			wantInitial:  100 * time.Millisecond,
+			wantMax:      time.Second,
+			wantFactor:   1.5,
+			wantJitter:   0.5,
+			wantDeadline: 10 * time.Second,
+		},
+		{name: "invalid duration", policy: RetryPolicy{InitialInterval: "soon"}, wantErr: true},
+		{name: "negative duration", policy: RetryPolicy{Deadline: "-1s"}, wantErr: true},
+		{name: "zero duration", policy: RetryPolicy{MaxInterval: "0s"}, wantErr: true},
+		{name: "shrinking multiplier", policy: RetryPolicy{Multiplier: 0.5}, wantErr: true},
+		{name: "negative jitter", policy: RetryPolicy{Jitter: -0.1}, wantErr: true},
+		{name: "jitter over 1", policy: RetryPolicy{Jitter: 1.5}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.parse()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parse() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse() = %v", err)
+			}
+			if got.backoff.Duration != tt.wantInitial || got.backoff.Cap != tt.wantMax ||
+				got.backoff.Factor != tt.wantFactor || got.backoff.Jitter != tt.wantJitter ||
+				got.deadline != tt.wantDeadline {
+				t.Errorf("parse() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+
+	tests := []struct {
+		name          string
+		err           error
+		wantReason    string
+		wantRetriable bool
+	}{
+		{"not found", apierrors.NewNotFound(pods, "cam-0"), "NotFound", true},
+		{"forbidden", apierrors.NewForbidden(pods, "cam-0", errors.New("rbac")), "Forbidden", false},
+		{"unauthorized", apierrors.NewUnauthorized("expired token"), "Unauthorized", false},
+		{"bad request", apierrors.NewBadRequest("bad"), "BadRequest", false},
+		{"too many requests", apierrors.NewTooManyRequests("slow down", 1), "TooManyRequests", true},
+		{"unavailable", apierrors.NewServiceUnavailable("starting"), "Unavailable", true},
+		{"server timeout", apierrors.NewServerTimeout(pods, "get", 1), "Unavailable", true},
+		{"internal error", apierrors.NewInternalError(errors.New("etcd")), "Unavailable", true},
+		{
+			name:          "network error",
+			err:           fmt.Errorf("get pod: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+			wantReason:    "Unavailable",
+			wantRetriable: true,
+		},
+		{"unknown", errors.New("something else"), "Unknown", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, retriable := classifyError(tt.err)
+			if reason != tt.wantReason || retriable != tt.wantRetriable {
+				t.Errorf("classifyError() = %s, %v, want %s, %v", reason, retriable, tt.wantReason, tt.wantRetriable)
+			}
+
+			// the retriable failures are the ones the runtime can try again later
+			wantCode := uint(types.ErrInternal)
+			if tt.wantRetriable {
+				wantCode = types.ErrTryAgainLater
+			}
+			if code := podLookupError(tt.err).Code; code != wantCode {
+				t.Errorf("podLookupError() code = %d, want %d", code, wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCodePluginNotAvailable is the CNI 1.1 STATUS error code of a plugin that cannot serve ADD yet
+const ErrCodePluginNotAvailable uint = 50
+
+// statusAPITimeout bounds the API server check of STATUS
+const statusAPITimeout = 5 * time.Second
+
+// statusBinaries returns the binaries of the installer that the configured backend needs in the CNI bin
+// directory, the in-process backends do not run msm-iptables
+func statusBinaries() []string {
+	if interceptRuleMgrType == "msm-iptables" {
+		return []string{"msm-cni", nsSetupProg}
+	}
+	return []string{"msm-cni"}
+}
+
+// CmdStatus is called for CNI STATUS requests. The plugin is not available until the installer has
+// written its kubeconfig and copied its binaries, and the API server is reachable.
+func CmdStatus(args *skel.CmdArgs) (err error) {
+	defer setupLogging(args)()
+	defer recoverPanic("STATUS", &err)
+
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		log.Errorf("error parsing msm-cni cmdStatus config: %v", err)
+		return err
+	}
+	applyPluginConf(conf)
+
+	if err := checkStatus(conf); err != nil {
+		log.Warnf("msm-cni is not available: %v", err)
+		return types.NewError(ErrCodePluginNotAvailable, "msm-cni is not available", err.Error())
+	}
+	if conf.Delegate != nil {
+		_, err = delegate(conf, "STATUS")
+		return err
+	}
+	return nil
+}
+
+// checkStatus returns why the plugin cannot serve ADD, nil when it can
+func checkStatus(conf *PluginConf) error {
+	kubeConfig := conf.Kubernetes.KubeConfig
+	if kubeConfig == "" {
+		return fmt.Errorf("no kubeConfig in the network configuration")
+	}
+	if _, err := os.Stat(kubeConfig); err != nil {
+		return fmt.Errorf("kubeconfig not written yet: %v", err)
+	}
+	for _, binary := range statusBinaries() {
+		if _, err := os.Stat(filepath.Join(nsSetupBinDir, binary)); err != nil {
+			return fmt.Errorf("%s not installed yet: %v", binary, err)
+		}
+	}
+
+	client, err := newKubeClient(*conf)
+	if err != nil {
+		return fmt.Errorf("invalid kubeconfig %s: %v", kubeConfig, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statusAPITimeout)
+	defer cancel()
+	if err := client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error(); err != nil {
+		return fmt.Errorf("API server not reachable: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package install
+
+import (
+	"context"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/agent"
+)
+
+// runAgent runs the node agent serving pod metadata to msm-cni until ctx is done.
+// msm-cni falls back to the API server when the agent is not available, so its failures are only logged.
+func runAgent(ctx context.Context, cfg *Config) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Errorf("Node agent not started, failed to load the in-cluster config: %v", err)
+		return
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Errorf("Node agent not started, failed to create the kubernetes client: %v", err)
+		return
+	}
+
+	if err := agent.NewServer(client, cfg.K8sNodeName, cfg.AgentSocket).Run(ctx); err != nil {
+		log.Errorf("Node agent stopped: %v", err)
+	}
+}
@@ -51,6 +51,7 @@ type cniConfigVars struct {
 	k8sServiceHost     string
 	k8sServicePort     string
 	k8sNodeName        string
+	agentSocket        string
 }
 
 func getPluginConfig(cfg *Config) pluginConfig {
@@ -76,6 +77,7 @@ func getCNIConfigVars(cfg *Config) cniConfigVars {
 		k8sServiceHost:     cfg.K8sServiceHost,
 		k8sServicePort:     cfg.K8sServicePort,
 		k8sNodeName:        cfg.K8sNodeName,
+		agentSocket:        cfg.AgentSocket,
 	}
 }
 
@@ -117,6 +119,7 @@ func replaceCNIConfigVars(cniConfig []byte, vars cniConfigVars, saToken string)
 	cniConfigStr = strings.ReplaceAll(cniConfigStr, "__KUBERNETES_SERVICE_HOST__", vars.k8sServiceHost)
 	cniConfigStr = strings.ReplaceAll(cniConfigStr, "__KUBERNETES_SERVICE_PORT__", vars.k8sServicePort)
 	cniConfigStr = strings.ReplaceAll(cniConfigStr, "__KUBERNETES_NODE_NAME__", vars.k8sNodeName)
+	cniConfigStr = strings.ReplaceAll(cniConfigStr, "__MSM_AGENT_SOCKET__", vars.agentSocket)
 
 	// Log the config file before inserting service account token.
 	// This way auth token is not visible in the logs.
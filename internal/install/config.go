@@ -66,6 +66,9 @@ type Config struct {
 
 	// The names of binaries to skip when copying
 	SkipCNIBinaries []string
+
+	// Unix socket the node agent serves pod metadata on, the agent is not run when empty
+	AgentSocket string
 }
 
 func (c *Config) String() string {
@@ -89,5 +92,6 @@ func (c *Config) String() string {
 	b.WriteString("K8sNodeName: " + c.K8sNodeName + "\n")
 	b.WriteString("UpdateCNIBinaries: " + fmt.Sprint(c.UpdateCNIBinaries) + "\n")
 	b.WriteString("SkipCNIBinaries: " + fmt.Sprint(c.SkipCNIBinaries) + "\n")
+	b.WriteString("AgentSocket: " + c.AgentSocket + "\n")
 	return b.String()
 }
@@ -30,6 +30,7 @@ const (
 	SkipTLSVerify        = "skip-tls-verify"
 	SkipCNIBinaries      = "skip-cni-binaries"
 	UpdateCNIBinaries    = "update-cni-binaries"
+	AgentSocket          = "agent-socket"
 )
 
 // Internal constants
@@ -49,6 +49,10 @@ var rootCmd = &cobra.Command{
 
 		isReady := StartServer()
 
+		if cfg.AgentSocket != "" {
+			go runAgent(ctx, cfg)
+		}
+
 		installer := NewInstaller(cfg, isReady)
 
 		if err = installer.Run(ctx); err != nil {
@@ -93,6 +97,8 @@ func init() {
 	registerBooleanParameter(SkipTLSVerify, false, "Whether to use insecure TLS in kubeconfig file")
 	registerBooleanParameter(UpdateCNIBinaries, true, "Update binaries")
 	registerStringArrayParameter(SkipCNIBinaries, []string{}, "Binaries that should not be installed")
+	registerStringParameter(AgentSocket, "/var/run/msm-cni/agent.sock",
+		"Unix socket the node agent serves pod metadata on, the same path on the host and in the container. Empty disables the agent")
 }
 
 func registerStringParameter(name, value, usage string) {
@@ -146,6 +152,8 @@ func constructConfig() (*Config, error) {
 		CNIBinTargetDirs:  []string{HostCNIBinDir, SecondaryBinDir},
 		UpdateCNIBinaries: viper.GetBool(UpdateCNIBinaries),
 		SkipCNIBinaries:   viper.GetStringSlice(SkipCNIBinaries),
+
+		AgentSocket: viper.GetString(AgentSocket),
 	}
 
 	if len(cfg.K8sNodeName) == 0 {
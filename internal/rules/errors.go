@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrRulesMissing is returned by Verify when some of the expected rules are not installed
+	ErrRulesMissing = errors.New("redirect rules missing")
+	// ErrRulesDrift is returned by Verify when the rules are installed but not as expected
+	ErrRulesDrift = errors.New("redirect rules drifted")
+)
+
+// RuleError reports the rule or chain an operation failed on
+type RuleError struct {
+	// Op is the operation that failed, e.g. restore, flush, delete or verify
+	Op       string
+	Table    string
+	Chain    string
+	RuleSpec []string
+	Err      error
+}
+
+func (e *RuleError) Error() string {
+	if e.Chain == "" {
+		return fmt.Sprintf("%s table %s: %v", e.Op, e.Table, e.Err)
+	}
+	if len(e.RuleSpec) == 0 {
+		return fmt.Sprintf("%s chain %s %s: %v", e.Op, e.Table, e.Chain, e.Err)
+	}
+	return fmt.Sprintf("%s rule %q in %s %s: %v", e.Op, strings.Join(e.RuleSpec, " "), e.Table, e.Chain, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
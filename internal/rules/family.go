@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// IP families the rules can be programmed for
+const (
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+
+	// IPv6LoopbackCIDR is never redirected, like NoRedirectDestAddr for IPv4
+	IPv6LoopbackCIDR = "::1/128"
+)
+
+// family holds the addresses the rules of an IP family are built with
+type family struct {
+	netlinkFamily int
+	loopbackCIDR  string
+	localAddr     string
+	anyAddr       string
+	defaultDst    string
+}
+
+func familyOf(proto iptables.Protocol, p Params) family {
+	if proto == iptables.ProtocolIPv6 {
+		return family{
+			netlinkFamily: netlink.FAMILY_V6,
+			loopbackCIDR:  IPv6LoopbackCIDR,
+			localAddr:     "::1",
+			anyAddr:       "::",
+			defaultDst:    "::/0",
+		}
+	}
+	return family{
+		netlinkFamily: netlink.FAMILY_V4,
+		loopbackCIDR:  p.NoRedirectDestAddr,
+		localAddr:     "127.0.0.1",
+		anyAddr:       "0.0.0.0",
+		defaultDst:    "0.0.0.0/0",
+	}
+}
+
+// Protocols returns the iptables protocols of the IP families the rules are programmed for
+func (p Params) Protocols() []iptables.Protocol {
+	if len(p.IPFamilies) == 0 {
+		return []iptables.Protocol{iptables.ProtocolIPv4}
+	}
+
+	var protos []iptables.Protocol
+	for _, ipFamily := range p.IPFamilies {
+		switch ipFamily {
+		case IPv4:
+			protos = append(protos, iptables.ProtocolIPv4)
+		case IPv6:
+			protos = append(protos, iptables.ProtocolIPv6)
+		}
+	}
+	return protos
+}
+
+// NewIPTables returns an iptables handle, backed by iptables or ip6tables, per IP family of the params
+func NewIPTables(p Params) ([]*iptables.IPTables, error) {
+	var handles []*iptables.IPTables
+	for _, proto := range p.Protocols() {
+		ipt, err := iptables.NewWithProtocol(proto)
+		if err != nil {
+			return nil, err
+		}
+		handles = append(handles, ipt)
+	}
+	return handles, nil
+}
+
+// CIDRsOf returns the CIDRs belonging to the IP family of proto
+func CIDRsOf(cidrs []string, proto iptables.Protocol) []string {
+	var matching []string
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if (ip.To4() == nil) == (proto == iptables.ProtocolIPv6) {
+			matching = append(matching, cidr)
+		}
+	}
+	return matching
+}
+
+func validateFamilies(p Params) error {
+	for _, ipFamily := range p.IPFamilies {
+		if ipFamily != IPv4 && ipFamily != IPv6 {
+			return fmt.Errorf("unsupported IP family %s", ipFamily)
+		}
+	}
+	for _, cidr := range p.ExcludeCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ValidatePort checks that port is a number in the 1-65535 range
+func ValidatePort(port string) error {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return fmt.Errorf("%s is not a valid port", port)
+	}
+	return nil
+}
+
+// ValidatePortRange checks that portRange is either a single port or a `first-last` range of ports
+func ValidatePortRange(portRange string) error {
+	first, last, isRange := strings.Cut(portRange, "-")
+	if err := ValidatePort(first); err != nil {
+		return err
+	}
+	if !isRange {
+		return nil
+	}
+	if err := ValidatePort(last); err != nil {
+		return err
+	}
+
+	firstPort, _ := strconv.Atoi(first)
+	lastPort, _ := strconv.Atoi(last)
+	if firstPort > lastPort {
+		return fmt.Errorf("%s is not a valid port range", portRange)
+	}
+	return nil
+}
+
+// iptablesPortRange converts a `first-last` range of ports to the `first:last` form iptables expects
+func iptablesPortRange(portRange string) string {
+	return strings.Replace(portRange, "-", ":", 1)
+}
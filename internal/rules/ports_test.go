@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import "testing"
+
+func TestValidatePortRange(t *testing.T) {
+	tests := []struct {
+		portRange string
+		wantErr   bool
+	}{
+		{"554", false},
+		{"1", false},
+		{"65535", false},
+		{"8000-8010", false},
+		{"8000-8000", false},
+		{"0", true},
+		{"65536", true},
+		{"rtsp", true},
+		{"", true},
+		{"-554", true},
+		{"554-", true},
+		{"8010-8000", true},
+		{"8000-8010-8020", true},
+		{"8000:8010", true},
+	}
+	for _, tt := range tests {
+		if err := ValidatePortRange(tt.portRange); (err != nil) != tt.wantErr {
+			t.Errorf("ValidatePortRange(%q) = %v, wantErr %v", tt.portRange, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// restoreLineRe finds the failing line in the iptables-restore errors, e.g. `line 5 failed`
+// or `Error occurred at line: 5`
+var restoreLineRe = regexp.MustCompile(`line:? (\d+)`)
+
+// restoreScript is an iptables-restore input that remembers what each of its lines programs
+type restoreScript struct {
+	b bytes.Buffer
+	// lines holds, for every line, the rule or chain it programs
+	lines []RuleError
+}
+
+func (s *restoreScript) line(target RuleError, format string, args ...interface{}) {
+	fmt.Fprintf(&s.b, format+"\n", args...)
+	s.lines = append(s.lines, target)
+}
+
+// failure returns the error for a failed iptables-restore run, pointing at the failing rule when
+// iptables-restore reports its line
+func (s *restoreScript) failure(err error, stderr string) error {
+	err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr))
+
+	match := restoreLineRe.FindStringSubmatch(stderr)
+	if match == nil {
+		return &RuleError{Op: "restore", Err: err}
+	}
+	n, _ := strconv.Atoi(match[1])
+	if n < 1 || n > len(s.lines) {
+		return &RuleError{Op: "restore", Err: err}
+	}
+	ruleErr := s.lines[n-1]
+	ruleErr.Op = "restore"
+	ruleErr.Err = err
+	return &ruleErr
+}
+
+// tableReader is the part of an iptables handle renderRestore reads the current tables with
+type tableReader interface {
+	Proto() iptables.Protocol
+	ChainExists(table, chain string) (bool, error)
+	Exists(table, chain string, rulespec ...string) (bool, error)
+}
+
+// renderRestore renders the msm-owned chains for p as an iptables-restore --noflush input.
+// Declaring a chain creates or flushes it, so the chains are rebuilt from scratch; the jumps
+// missing from the built-in chains are added and the chains p does not use are removed.
+func renderRestore(ipt tableReader, p Params) (*restoreScript, error) {
+	ruleSet := RuleSet(p, ipt.Proto())
+	chains := Chains(ruleSet)
+
+	s := &restoreScript{}
+	for _, table := range []string{natTable, mangleTable} {
+		var used, unused []Chain
+		for _, chain := range msmChains {
+			if chain.Table != table {
+				continue
+			}
+			if containsChain(chains, chain) {
+				used = append(used, chain)
+				continue
+			}
+			exists, err := ipt.ChainExists(table, chain.Name)
+			if err != nil {
+				return nil, &RuleError{Op: "list", Table: table, Chain: chain.Name, Err: err}
+			}
+			if exists {
+				unused = append(unused, chain)
+			}
+		}
+		if len(used) == 0 && len(unused) == 0 {
+			continue
+		}
+
+		s.line(RuleError{Table: table}, "*%s", table)
+		for _, chain := range append(used, unused...) {
+			s.line(RuleError{Table: table, Chain: chain.Name}, ":%s - [0:0]", chain.Name)
+		}
+		for _, rule := range ruleSet {
+			if rule.Table == table {
+				s.line(RuleError{Table: table, Chain: rule.Chain, RuleSpec: rule.Spec},
+					"-A %s %s", rule.Chain, strings.Join(rule.Spec, " "))
+			}
+		}
+		for _, chain := range append(used, unused...) {
+			if chain.Hook == "" {
+				continue
+			}
+			jump := []string{"-j", chain.Name}
+			exists, err := ipt.Exists(table, chain.Hook, jump...)
+			if err != nil {
+				return nil, &RuleError{Op: "list", Table: table, Chain: chain.Hook, RuleSpec: jump, Err: err}
+			}
+			switch {
+			case containsChain(used, chain) && !exists:
+				s.line(RuleError{Table: table, Chain: chain.Hook, RuleSpec: jump}, "-A %s -j %s", chain.Hook, chain.Name)
+			case containsChain(unused, chain) && exists:
+				s.line(RuleError{Table: table, Chain: chain.Hook, RuleSpec: jump}, "-D %s -j %s", chain.Hook, chain.Name)
+			}
+		}
+		for _, chain := range unused {
+			s.line(RuleError{Table: table, Chain: chain.Name}, "-X %s", chain.Name)
+		}
+		s.line(RuleError{Table: table}, "COMMIT")
+	}
+	return s, nil
+}
+
+// Snapshot is the state of the tables msm programs for one IP family, taken before programming them
+type Snapshot struct {
+	ipt *iptables.IPTables
+	p   Params
+	// saved is the iptables-save output of the nat and mangle tables
+	saved []byte
+	// routing is whether the TPROXY policy routing was already set up
+	routing bool
+}
+
+// TakeSnapshot saves the nat and mangle tables of the IP family of ipt
+func TakeSnapshot(ipt *iptables.IPTables, p Params) (*Snapshot, error) {
+	s := &Snapshot{ipt: ipt, p: p}
+	for _, table := range []string{natTable, mangleTable} {
+		var stderr bytes.Buffer
+		cmd := exec.Command(saveCommand(ipt.Proto()), "-t", table)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("saving the %s table failed: %v: %s", table, err, strings.TrimSpace(stderr.String()))
+		}
+		s.saved = append(s.saved, out...)
+	}
+	s.routing = p.NeedsTProxyRouting() && VerifyTProxyRouting(p, ipt.Proto()) == nil
+	return s, nil
+}
+
+// Restore brings the tables and the TPROXY policy routing back to their state in the snapshot
+func (s *Snapshot) Restore() error {
+	// without --noflush the saved tables replace the current ones
+	var stderr bytes.Buffer
+	if err := runRestore(s.ipt, s.saved, false, &stderr); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if s.p.NeedsTProxyRouting() && !s.routing {
+		return DelTProxyRouting(s.p, s.ipt.Proto())
+	}
+	return nil
+}
+
+// ApplyAll programs the redirect rules for every IP family of handles as a single transaction:
+// when any family fails, every family is restored to its state before ApplyAll was called.
+// The returned error is a *RuleError pointing at the rule that failed when it is known.
+func ApplyAll(handles []*iptables.IPTables, p Params) error {
+	if err := Validate(p); err != nil {
+		return err
+	}
+
+	var snapshots []*Snapshot
+	for _, ipt := range handles {
+		snapshot, err := TakeSnapshot(ipt, p)
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	for _, ipt := range handles {
+		if err := apply(ipt, p); err != nil {
+			// every family is restored even when restoring another one fails
+			var rbErrs []error
+			for _, snapshot := range snapshots {
+				if rbErr := snapshot.Restore(); rbErr != nil {
+					rbErrs = append(rbErrs, fmt.Errorf("restoring the previous %s rules failed: %v", familyName(snapshot.ipt), rbErr))
+				}
+			}
+			if rbErr := errors.Join(rbErrs...); rbErr != nil {
+				return fmt.Errorf("%w (%v)", err, rbErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// apply programs the msm-owned chains of one IP family with a single iptables-restore
+// run, then sets up the TPROXY policy routing
+func apply(ipt *iptables.IPTables, p Params) error {
+	script, err := renderRestore(ipt, p)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	if err := runRestore(ipt, script.b.Bytes(), true, &stderr); err != nil {
+		return script.failure(err, stderr.String())
+	}
+
+	if p.NeedsTProxyRouting() {
+		return AddTProxyRouting(p, ipt.Proto())
+	}
+	return nil
+}
+
+// runRestore feeds input to iptables-restore for the IP family of ipt
+func runRestore(ipt *iptables.IPTables, input []byte, noflush bool, stderr *bytes.Buffer) error {
+	var args []string
+	if noflush {
+		args = append(args, "--noflush")
+	}
+	// iptables-restore waits for the xtables lock since 1.6.2
+	if v1, v2, v3 := ipt.GetIptablesVersion(); v1 > 1 || (v1 == 1 && (v2 > 6 || (v2 == 6 && v3 >= 2))) {
+		args = append(args, "--wait")
+	}
+
+	cmd := exec.Command(restoreCommand(ipt.Proto()), args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+func saveCommand(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ip6tables-save"
+	}
+	return "iptables-save"
+}
+
+func restoreCommand(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ip6tables-restore"
+	}
+	return "iptables-restore"
+}
+
+func familyName(ipt *iptables.IPTables) string {
+	if ipt.Proto() == iptables.ProtocolIPv6 {
+		return IPv6
+	}
+	return IPv4
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// fakeTables holds the chains and the jumps of the built-in chains that exist, keyed by table,
+// and the rules of the chains the way `iptables -S` lists them, keyed by table and chain
+type fakeTables struct {
+	proto  iptables.Protocol
+	chains map[string][]string
+	jumps  map[string][]string
+	rules  map[string][]string
+}
+
+func (f *fakeTables) Proto() iptables.Protocol {
+	return f.proto
+}
+
+func (f *fakeTables) ChainExists(table, chain string) (bool, error) {
+	return containsString(f.chains[table], chain), nil
+}
+
+func (f *fakeTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return containsString(f.jumps[table], chain+" "+strings.Join(rulespec, " ")), nil
+}
+
+func (f *fakeTables) List(table, chain string) ([]string, error) {
+	return append([]string{"-N " + chain}, f.rules[table+" "+chain]...), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func redirectParams() Params {
+	return Params{
+		ProxyPort:          "8554",
+		ProxyUID:           "1337",
+		NoRedirectDestAddr: "127.0.0.0/8",
+		InterceptPorts:     []string{"554", "8000-8010"},
+	}
+}
+
+func TestRenderRestore(t *testing.T) {
+	tproxy := redirectParams()
+	tproxy.RedirectMode = RedirectModeTPROXY
+	tproxy.UDPInterceptPorts = []string{"20000-30000"}
+
+	tests := []struct {
+		name   string
+		tables *fakeTables
+		p      Params
+		want   string
+	}{
+		{
+			name:   "empty tables",
+			tables: &fakeTables{proto: iptables.ProtocolIPv4},
+			p:      redirectParams(),
+			want: `*nat
+:MSM_OUTPUT - [0:0]
+:MSM_REDIRECT - [0:0]
+-A MSM_OUTPUT -d 127.0.0.0/8 -j RETURN
+-A MSM_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
+-A MSM_OUTPUT -p tcp --dport 554 -j MSM_REDIRECT
+-A MSM_OUTPUT -p tcp --dport 8000:8010 -j MSM_REDIRECT
+-A MSM_REDIRECT -p tcp -j REDIRECT --to-ports 8554
+-A OUTPUT -j MSM_OUTPUT
+COMMIT
+`,
+		},
+		{
+			name: "hooked chains and leftover TPROXY chains",
+			tables: &fakeTables{
+				proto: iptables.ProtocolIPv4,
+				chains: map[string][]string{
+					natTable:    {msmOutputChain, msmRedirectChain},
+					mangleTable: {msmOutputChain, msmPreroutingChain},
+				},
+				jumps: map[string][]string{
+					natTable:    {"OUTPUT -j MSM_OUTPUT"},
+					mangleTable: {"OUTPUT -j MSM_OUTPUT", "PREROUTING -j MSM_PREROUTING"},
+				},
+			},
+			p: redirectParams(),
+			want: `*nat
+:MSM_OUTPUT - [0:0]
+:MSM_REDIRECT - [0:0]
+-A MSM_OUTPUT -d 127.0.0.0/8 -j RETURN
+-A MSM_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
+-A MSM_OUTPUT -p tcp --dport 554 -j MSM_REDIRECT
+-A MSM_OUTPUT -p tcp --dport 8000:8010 -j MSM_REDIRECT
+-A MSM_REDIRECT -p tcp -j REDIRECT --to-ports 8554
+COMMIT
+*mangle
+:MSM_OUTPUT - [0:0]
+:MSM_PREROUTING - [0:0]
+-D OUTPUT -j MSM_OUTPUT
+-D PREROUTING -j MSM_PREROUTING
+-X MSM_OUTPUT
+-X MSM_PREROUTING
+COMMIT
+`,
+		},
+		{
+			name:   "TPROXY on IPv6",
+			tables: &fakeTables{proto: iptables.ProtocolIPv6},
+			p:      tproxy,
+			want: `*nat
+:MSM_OUTPUT - [0:0]
+:MSM_REDIRECT - [0:0]
+-A MSM_OUTPUT -d ::1/128 -j RETURN
+-A MSM_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
+-A MSM_OUTPUT -p tcp --dport 554 -j MSM_REDIRECT
+-A MSM_OUTPUT -p tcp --dport 8000:8010 -j MSM_REDIRECT
+-A MSM_REDIRECT -p tcp -j REDIRECT --to-ports 8554
+-A OUTPUT -j MSM_OUTPUT
+COMMIT
+*mangle
+:MSM_OUTPUT - [0:0]
+:MSM_PREROUTING - [0:0]
+-A MSM_OUTPUT -d ::1/128 -j RETURN
+-A MSM_OUTPUT -p udp -m owner --uid-owner 1337 -j RETURN
+-A MSM_OUTPUT -p udp --dport 20000:30000 -j MARK --set-xmark 0x539/0xffffffff
+-A MSM_PREROUTING -i lo -p udp -m mark --mark 0x539 -j TPROXY --on-port 8554 --on-ip ::1 --tproxy-mark 0x539/0xffffffff
+-A OUTPUT -j MSM_OUTPUT
+-A PREROUTING -j MSM_PREROUTING
+COMMIT
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := renderRestore(tt.tables, tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := script.b.String(); got != tt.want {
+				t.Errorf("renderRestore() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if lines := strings.Count(script.b.String(), "\n"); lines != len(script.lines) {
+				t.Errorf("renderRestore() has %d lines but records %d", lines, len(script.lines))
+			}
+		})
+	}
+}
+
+func TestRestoreScriptFailure(t *testing.T) {
+	script, err := renderRestore(&fakeTables{proto: iptables.ProtocolIPv4}, redirectParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runErr := errors.New("exit status 1")
+
+	tests := []struct {
+		name   string
+		stderr string
+		want   RuleError
+	}{
+		{
+			name:   "failed rule",
+			stderr: "iptables-restore: line 7 failed\n",
+			want: RuleError{Op: "restore", Table: natTable, Chain: msmOutputChain,
+				RuleSpec: []string{"-p", "tcp", "--dport", "8000:8010", "-j", msmRedirectChain}},
+		},
+		{
+			name:   "failed chain declaration",
+			stderr: "iptables-restore v1.8.7 (legacy): Error occurred at line: 2\n",
+			want:   RuleError{Op: "restore", Table: natTable, Chain: msmOutputChain},
+		},
+		{
+			name:   "failed hook",
+			stderr: "iptables-restore: line 9 failed\n",
+			want: RuleError{Op: "restore", Table: natTable, Chain: outputChain,
+				RuleSpec: []string{"-j", msmOutputChain}},
+		},
+		{
+			name:   "line out of the script",
+			stderr: "iptables-restore: line 42 failed\n",
+			want:   RuleError{Op: "restore"},
+		},
+		{
+			name:   "no line",
+			stderr: "iptables-restore: unable to initialize table 'nat'\n",
+			want:   RuleError{Op: "restore"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := script.failure(runErr, tt.stderr)
+			var ruleErr *RuleError
+			if !errors.As(err, &ruleErr) {
+				t.Fatalf("failure() = %v, want a *RuleError", err)
+			}
+			if ruleErr.Op != tt.want.Op || ruleErr.Table != tt.want.Table || ruleErr.Chain != tt.want.Chain ||
+				strings.Join(ruleErr.RuleSpec, " ") != strings.Join(tt.want.RuleSpec, " ") {
+				t.Errorf("failure() = %+v, want %+v", ruleErr, tt.want)
+			}
+			if !strings.Contains(err.Error(), strings.TrimSpace(tt.stderr)) {
+				t.Errorf("failure() = %q, want the iptables-restore output", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// tproxyRule is the policy routing rule looking up TProxyRouteTable for the marked packets
+func tproxyRule(fam family) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = fam.netlinkFamily
+	rule.Mark = TProxyMark
+	rule.Table = TProxyRouteTable
+	return rule
+}
+
+// tproxyRoute is the route delivering every packet looked up in TProxyRouteTable locally
+func tproxyRoute(fam family) (*netlink.Route, error) {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return nil, err
+	}
+
+	_, dst, _ := net.ParseCIDR(fam.defaultDst)
+	return &netlink.Route{
+		LinkIndex: lo.Attrs().Index,
+		Dst:       dst,
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+		Table:     TProxyRouteTable,
+	}, nil
+}
+
+// AddTProxyRouting sets up the policy routing delivering the packets marked with TProxyMark
+// locally for the IP family of proto, the equivalent of:
+//
+//	ip rule add fwmark 0x539 lookup 133
+//	ip route add local 0.0.0.0/0 dev lo table 133
+func AddTProxyRouting(p Params, proto iptables.Protocol) error {
+	fam := familyOf(proto, p)
+	route, err := tproxyRoute(fam)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to add route to table %d: %v", TProxyRouteTable, err)
+	}
+
+	exists, err := tproxyRuleExists(fam)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := netlink.RuleAdd(tproxyRule(fam)); err != nil {
+			return fmt.Errorf("failed to add fwmark %#x rule: %v", TProxyMark, err)
+		}
+	}
+	return nil
+}
+
+// DelTProxyRouting removes the policy routing set up by AddTProxyRouting, if any.
+func DelTProxyRouting(p Params, proto iptables.Protocol) error {
+	fam := familyOf(proto, p)
+	if err := netlink.RuleDel(tproxyRule(fam)); err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete fwmark %#x rule: %v", TProxyMark, err)
+	}
+
+	route, err := tproxyRoute(fam)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteDel(route); err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete route from table %d: %v", TProxyRouteTable, err)
+	}
+	return nil
+}
+
+// VerifyTProxyRouting checks that the policy routing set up by AddTProxyRouting is in place.
+// The returned error wraps ErrRulesMissing when it is not.
+func VerifyTProxyRouting(p Params, proto iptables.Protocol) error {
+	fam := familyOf(proto, p)
+	exists, err := tproxyRuleExists(fam)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: no fwmark %#x rule looking up table %d", ErrRulesMissing, TProxyMark, TProxyRouteTable)
+	}
+
+	routes, err := netlink.RouteListFiltered(fam.netlinkFamily,
+		&netlink.Route{Table: TProxyRouteTable}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.Type == unix.RTN_LOCAL {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no local route in table %d", ErrRulesMissing, TProxyRouteTable)
+}
+
+func tproxyRuleExists(fam family) (bool, error) {
+	rules, err := netlink.RuleList(fam.netlinkFamily)
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		if rule.Mark == TProxyMark && rule.Table == TProxyRouteTable {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ESRCH)
+}
@@ -0,0 +1,556 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rules builds the iptables rules redirecting pod traffic to the MSM proxy.
+// It is shared by msm-cni and the msm-iptables executable and expects to be called
+// from within the pod network namespace.
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	RedirectModeREDIRECT = "REDIRECT"
+	RedirectModeTPROXY   = "TPROXY"
+	RTSPPort             = "554"
+	// AllPorts intercepts every inbound port
+	AllPorts = "*"
+
+	// TProxyMark marks the UDP packets steered to the proxy with TPROXY, 0x539 (1337)
+	TProxyMark = 0x539
+	// TProxyRouteTable is the routing table delivering the marked packets locally
+	TProxyRouteTable = 133
+
+	natTable        = "nat"
+	mangleTable     = "mangle"
+	outputChain     = "OUTPUT"
+	preroutingChain = "PREROUTING"
+
+	// msm-owned chains, the built-in chains only hold a single jump to them
+	msmOutputChain       = "MSM_OUTPUT"
+	msmPreroutingChain   = "MSM_PREROUTING"
+	msmRedirectChain     = "MSM_REDIRECT"
+	msmInboundRedirChain = "MSM_IN_REDIRECT"
+)
+
+// Chain is an msm-owned chain
+type Chain struct {
+	Table string
+	Name  string
+	// Hook is the built-in chain jumping to the chain, empty for the chains only used as a jump target
+	Hook string
+}
+
+// msmChains lists every chain msm may own, whatever the parameters
+var msmChains = []Chain{
+	{Table: natTable, Name: msmOutputChain, Hook: outputChain},
+	{Table: natTable, Name: msmPreroutingChain, Hook: preroutingChain},
+	{Table: natTable, Name: msmRedirectChain},
+	{Table: natTable, Name: msmInboundRedirChain},
+	{Table: mangleTable, Name: msmOutputChain, Hook: outputChain},
+	{Table: mangleTable, Name: msmPreroutingChain, Hook: preroutingChain},
+}
+
+// Params holds the parameters the redirect rules are built from
+type Params struct {
+	// Port of the MSM proxy the traffic is redirected to
+	ProxyPort string
+	// UID of the proxy, its own traffic is not redirected
+	ProxyUID string
+	// IPv4 destination addresses that are never redirected, IPv6LoopbackCIDR is used for IPv6
+	NoRedirectDestAddr string
+	// Additional IPv4 or IPv6 destination CIDRs that are never redirected
+	ExcludeCIDRs []string
+	// Additional UIDs and GIDs whose traffic is never redirected, e.g. helper containers bypassing the proxy
+	ExcludeUIDs []string
+	ExcludeGIDs []string
+	// IP families the rules are programmed for, IPv4 and/or IPv6. Defaults to IPv4.
+	IPFamilies []string
+	// Destination ports or `first-last` port ranges redirected to the proxy, defaults to RTSPPort
+	InterceptPorts []string
+	// How the traffic is redirected, REDIRECT (the default) or TPROXY
+	RedirectMode string
+	// Destination UDP ports or port ranges steered to the proxy in TPROXY mode
+	UDPInterceptPorts []string
+	// Port of the MSM proxy UDP socket in TPROXY mode, defaults to ProxyPort
+	TProxyPort string
+
+	// How inbound traffic is intercepted, REDIRECT (the default) or TPROXY
+	InboundInterceptMode string
+	// Inbound TCP ports or port ranges intercepted, AllPorts for every port.
+	// Inbound traffic is not intercepted when empty.
+	InboundPorts []string
+	// Inbound TCP ports or port ranges never intercepted
+	InboundExcludePorts []string
+	// Port of the MSM proxy inbound listener
+	InboundProxyPort string
+}
+
+// Rule is a single iptables rule in an msm-owned chain
+type Rule struct {
+	Table string
+	Chain string
+	Spec  []string
+}
+
+// RuleSet returns the rules for the given parameters and iptables protocol, in the order they are appended.
+func RuleSet(p Params, proto iptables.Protocol) []Rule {
+	var rules []Rule
+	fam := familyOf(proto, p)
+
+	// iptables -t nat -A MSM_OUTPUT -d 127.0.0.0/8 -j RETURN
+	// iptables -t nat -A MSM_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
+	for _, spec := range exemptionSpecs(p, fam, proto, "tcp") {
+		rules = append(rules, Rule{Table: natTable, Chain: msmOutputChain, Spec: spec})
+	}
+
+	interceptPorts := p.InterceptPorts
+	if len(interceptPorts) == 0 {
+		interceptPorts = []string{RTSPPort}
+	}
+	for _, port := range interceptPorts {
+		// iptables -t nat -A MSM_OUTPUT -p tcp --dport 554 -j MSM_REDIRECT
+		rules = append(rules, Rule{Table: natTable, Chain: msmOutputChain, Spec: []string{
+			"-p", "tcp", "--dport", iptablesPortRange(port), "-j", msmRedirectChain,
+		}})
+	}
+	// iptables -t nat -A MSM_REDIRECT -p tcp -j REDIRECT --to-ports 8554
+	rules = append(rules, Rule{Table: natTable, Chain: msmRedirectChain, Spec: []string{
+		"-p", "tcp", "-j", RedirectModeREDIRECT, "--to-ports", p.ProxyPort,
+	}})
+
+	rules = append(rules, inboundRules(p, fam)...)
+
+	if p.RedirectMode != RedirectModeTPROXY {
+		return rules
+	}
+
+	// Locally generated packets can only be steered with TPROXY once they come back in
+	// through lo: they are marked in mangle OUTPUT, policy routing delivers the marked
+	// packets locally, and mangle PREROUTING hands them to the proxy.
+	for _, spec := range exemptionSpecs(p, fam, proto, "udp") {
+		rules = append(rules, Rule{Table: mangleTable, Chain: msmOutputChain, Spec: spec})
+	}
+	mark := fmt.Sprintf("%#x", TProxyMark)
+	for _, port := range p.UDPInterceptPorts {
+		// iptables -t mangle -A MSM_OUTPUT -p udp --dport 20000:30000 -j MARK --set-xmark 0x539/0xffffffff
+		rules = append(rules, Rule{Table: mangleTable, Chain: msmOutputChain, Spec: []string{
+			"-p", "udp", "--dport", iptablesPortRange(port), "-j", "MARK", "--set-xmark", mark + "/0xffffffff",
+		}})
+	}
+
+	tproxyPort := p.TProxyPort
+	if tproxyPort == "" {
+		tproxyPort = p.ProxyPort
+	}
+	// iptables -t mangle -A MSM_PREROUTING -i lo -p udp -m mark --mark 0x539
+	//   -j TPROXY --on-port 8554 --on-ip 127.0.0.1 --tproxy-mark 0x539/0xffffffff
+	rules = append(rules, Rule{Table: mangleTable, Chain: msmPreroutingChain, Spec: []string{
+		"-i", "lo", "-p", "udp", "-m", "mark", "--mark", mark,
+		"-j", RedirectModeTPROXY, "--on-port", tproxyPort, "--on-ip", fam.localAddr,
+		"--tproxy-mark", mark + "/0xffffffff",
+	}})
+
+	return rules
+}
+
+// inboundRules returns the MSM_PREROUTING rules intercepting the inbound traffic
+func inboundRules(p Params, fam family) []Rule {
+	if len(p.InboundPorts) == 0 {
+		return nil
+	}
+
+	var rules []Rule
+	table := natTable
+	var prefix, target []string
+	if p.InboundInterceptMode == RedirectModeTPROXY {
+		// the TPROXY-ed connections are delivered locally through the same policy routing as the outbound UDP
+		mark := fmt.Sprintf("%#x", TProxyMark)
+		table = mangleTable
+		prefix = []string{"!", "-i", "lo"}
+		target = []string{
+			"-j", RedirectModeTPROXY, "--on-port", p.InboundProxyPort, "--on-ip", fam.anyAddr,
+			"--tproxy-mark", mark + "/0xffffffff",
+		}
+	} else {
+		// iptables -t nat -A MSM_IN_REDIRECT -p tcp -j REDIRECT --to-ports 8555
+		rules = append(rules, Rule{Table: table, Chain: msmInboundRedirChain, Spec: []string{
+			"-p", "tcp", "-j", RedirectModeREDIRECT, "--to-ports", p.InboundProxyPort,
+		}})
+		target = []string{"-j", msmInboundRedirChain}
+	}
+
+	for _, port := range p.InboundExcludePorts {
+		// iptables -t nat -A MSM_PREROUTING -p tcp --dport 22 -j RETURN
+		spec := append(append([]string{}, prefix...), "-p", "tcp", "--dport", iptablesPortRange(port), "-j", "RETURN")
+		rules = append(rules, Rule{Table: table, Chain: msmPreroutingChain, Spec: spec})
+	}
+	for _, port := range p.InboundPorts {
+		// iptables -t nat -A MSM_PREROUTING -p tcp --dport 554 -j MSM_IN_REDIRECT
+		// iptables -t mangle -A MSM_PREROUTING ! -i lo -p tcp --dport 554
+		//   -j TPROXY --on-port 8555 --on-ip 0.0.0.0 --tproxy-mark 0x539/0xffffffff
+		spec := append(append([]string{}, prefix...), "-p", "tcp")
+		if port != AllPorts {
+			spec = append(spec, "--dport", iptablesPortRange(port))
+		}
+		rules = append(rules, Rule{Table: table, Chain: msmPreroutingChain, Spec: append(spec, target...)})
+	}
+	return rules
+}
+
+// Chains returns the msm-owned chains holding the rules of ruleSet
+func Chains(ruleSet []Rule) []Chain {
+	var chains []Chain
+	for _, chain := range msmChains {
+		for _, rule := range ruleSet {
+			if rule.Table == chain.Table && rule.Chain == chain.Name {
+				chains = append(chains, chain)
+				break
+			}
+		}
+	}
+	return chains
+}
+
+// NeedsTProxyRouting reports whether any of the traffic is steered to the proxy with TPROXY
+func (p Params) NeedsTProxyRouting() bool {
+	return p.RedirectMode == RedirectModeTPROXY ||
+		(p.InboundInterceptMode == RedirectModeTPROXY && len(p.InboundPorts) > 0)
+}
+
+// exemptionSpecs returns the rules exempting traffic from the redirection
+func exemptionSpecs(p Params, fam family, proto iptables.Protocol, l4proto string) [][]string {
+	specs := [][]string{{"-d", fam.loopbackCIDR, "-j", "RETURN"}}
+	for _, cidr := range CIDRsOf(p.ExcludeCIDRs, proto) {
+		specs = append(specs, []string{"-d", cidr, "-j", "RETURN"})
+	}
+	specs = append(specs, []string{"-p", l4proto, "-m", "owner", "--uid-owner", p.ProxyUID, "-j", "RETURN"})
+	// iptables -t nat -A MSM_OUTPUT -p tcp -m owner --uid-owner 1500 -j RETURN
+	for _, uid := range p.ExcludeUIDs {
+		specs = append(specs, []string{"-p", l4proto, "-m", "owner", "--uid-owner", uid, "-j", "RETURN"})
+	}
+	// iptables -t nat -A MSM_OUTPUT -p tcp -m owner --gid-owner 1500 -j RETURN
+	for _, gid := range p.ExcludeGIDs {
+		specs = append(specs, []string{"-p", l4proto, "-m", "owner", "--gid-owner", gid, "-j", "RETURN"})
+	}
+	return specs
+}
+
+// ValidateID checks that id is a UID or GID
+func ValidateID(id string) error {
+	if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+		return fmt.Errorf("invalid UID or GID %q", id)
+	}
+	return nil
+}
+
+// Validate checks the parameters before any rule is built from them
+func Validate(p Params) error {
+	if err := validateFamilies(p); err != nil {
+		return err
+	}
+
+	switch p.RedirectMode {
+	case "", RedirectModeREDIRECT:
+	case RedirectModeTPROXY:
+		if len(p.UDPInterceptPorts) == 0 {
+			return fmt.Errorf("redirect mode %s requires UDP intercept ports", p.RedirectMode)
+		}
+	default:
+		return fmt.Errorf("unsupported redirect mode %s", p.RedirectMode)
+	}
+
+	for _, port := range append(p.InterceptPorts, p.UDPInterceptPorts...) {
+		if err := ValidatePortRange(port); err != nil {
+			return err
+		}
+	}
+	for _, id := range append(append([]string{}, p.ExcludeUIDs...), p.ExcludeGIDs...) {
+		if err := ValidateID(id); err != nil {
+			return err
+		}
+	}
+
+	switch p.InboundInterceptMode {
+	case "", RedirectModeREDIRECT, RedirectModeTPROXY:
+	default:
+		return fmt.Errorf("unsupported inbound intercept mode %s", p.InboundInterceptMode)
+	}
+	if len(p.InboundPorts) > 0 {
+		if err := ValidatePort(p.InboundProxyPort); err != nil {
+			return fmt.Errorf("invalid inbound proxy port: %v", err)
+		}
+	}
+	for _, port := range p.InboundPorts {
+		if port == AllPorts && len(p.InboundPorts) == 1 {
+			continue
+		}
+		if err := ValidatePortRange(port); err != nil {
+			return err
+		}
+	}
+	for _, port := range p.InboundExcludePorts {
+		if err := ValidatePortRange(port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply programs the redirect rules for the IP family of ipt and, when TPROXY is used, sets up the policy routing.
+// The msm-owned chains are rebuilt with a single iptables-restore run, and each is reached by a single jump from
+// its built-in chain, so applying the same or different parameters again never duplicates rules. The chains the
+// parameters do not use anymore are removed. The previous state is restored when anything fails.
+func Apply(ipt *iptables.IPTables, p Params) error {
+	return ApplyAll([]*iptables.IPTables{ipt}, p)
+}
+
+// Clean unhooks and deletes the msm-owned chains, and removes the TPROXY policy routing.
+// Only the IP families of p matter, the chains and routing that are not present are ignored.
+func Clean(ipt *iptables.IPTables, p Params) error {
+	if err := deleteChains(ipt, msmChains); err != nil {
+		return err
+	}
+
+	return DelTProxyRouting(p, ipt.Proto())
+}
+
+// deleteChains removes the jumps to the chains, then flushes and deletes the chains that exist.
+// The chains are all flushed before any is deleted since they may jump to each other.
+func deleteChains(ipt *iptables.IPTables, chains []Chain) error {
+	var existing []Chain
+	for _, chain := range chains {
+		if chain.Hook != "" {
+			jump := []string{"-j", chain.Name}
+			if err := ipt.DeleteIfExists(chain.Table, chain.Hook, jump...); err != nil {
+				return &RuleError{Op: "delete", Table: chain.Table, Chain: chain.Hook, RuleSpec: jump, Err: err}
+			}
+		}
+
+		exists, err := ipt.ChainExists(chain.Table, chain.Name)
+		if err != nil {
+			return &RuleError{Op: "delete", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+		if exists {
+			existing = append(existing, chain)
+		}
+	}
+
+	for _, chain := range existing {
+		if err := ipt.ClearChain(chain.Table, chain.Name); err != nil {
+			return &RuleError{Op: "flush", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+	}
+	for _, chain := range existing {
+		if err := ipt.DeleteChain(chain.Table, chain.Name); err != nil {
+			return &RuleError{Op: "delete", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+func containsChain(chains []Chain, chain Chain) bool {
+	for _, c := range chains {
+		if c.Table == chain.Table && c.Name == chain.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks that the msm-owned chains are hooked and hold exactly the redirect rules, in order,
+// that no other msm-owned chain is left, and that the TPROXY policy routing is set up when TPROXY is used.
+// The returned error wraps ErrRulesMissing or ErrRulesDrift when they are not.
+func Verify(ipt *iptables.IPTables, p Params) error {
+	if err := verifyChains(ipt, p); err != nil {
+		return err
+	}
+
+	if p.NeedsTProxyRouting() {
+		return VerifyTProxyRouting(p, ipt.Proto())
+	}
+	return nil
+}
+
+// tableLister is the part of an iptables handle verifyChains reads the current tables with
+type tableLister interface {
+	tableReader
+	List(table, chain string) ([]string, error)
+}
+
+// verifyChains checks the msm-owned chains of the IP family of ipt for Verify
+func verifyChains(ipt tableLister, p Params) error {
+	ruleSet := RuleSet(p, ipt.Proto())
+	chains := Chains(ruleSet)
+
+	for _, chain := range chains {
+		exists, err := ipt.ChainExists(chain.Table, chain.Name)
+		if err != nil {
+			return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+		if !exists {
+			return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Name, Err: ErrRulesMissing}
+		}
+
+		if chain.Hook != "" {
+			jump := []string{"-j", chain.Name}
+			exists, err := ipt.Exists(chain.Table, chain.Hook, jump...)
+			if err != nil {
+				return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Hook, RuleSpec: jump, Err: err}
+			}
+			if !exists {
+				return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Hook, RuleSpec: jump, Err: ErrRulesMissing}
+			}
+		}
+
+		// the first listed line is the `-N` chain declaration
+		listed, err := ipt.List(chain.Table, chain.Name)
+		if err != nil {
+			return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+		if len(listed) > 0 {
+			listed = listed[1:]
+		}
+
+		pos := 0
+		for _, rule := range ruleSet {
+			if rule.Table != chain.Table || rule.Chain != chain.Name {
+				continue
+			}
+			if pos < len(listed) && findRule(listed, rule.Spec, pos) == pos {
+				pos++
+				continue
+			}
+
+			exists, err := ipt.Exists(rule.Table, rule.Chain, rule.Spec...)
+			if err != nil {
+				return &RuleError{Op: "verify", Table: rule.Table, Chain: rule.Chain, RuleSpec: rule.Spec, Err: err}
+			}
+			if !exists {
+				return &RuleError{Op: "verify", Table: rule.Table, Chain: rule.Chain, RuleSpec: rule.Spec, Err: ErrRulesMissing}
+			}
+			return &RuleError{Op: "verify", Table: rule.Table, Chain: rule.Chain, RuleSpec: rule.Spec, Err: ErrRulesDrift}
+		}
+		if pos != len(listed) {
+			return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Name, RuleSpec: strings.Fields(listed[pos]),
+				Err: ErrRulesDrift}
+		}
+	}
+
+	// a leftover chain still diverts the traffic the way the previous parameters did, e.g. the
+	// mangle MSM_OUTPUT marking UDP for a pod switched to REDIRECT mode
+	for _, chain := range msmChains {
+		if containsChain(chains, chain) {
+			continue
+		}
+		exists, err := ipt.ChainExists(chain.Table, chain.Name)
+		if err != nil {
+			return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+		if exists {
+			return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Name, Err: ErrRulesDrift}
+		}
+
+		if chain.Hook != "" {
+			jump := []string{"-j", chain.Name}
+			hooked, err := ipt.Exists(chain.Table, chain.Hook, jump...)
+			if err != nil {
+				return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Hook, RuleSpec: jump, Err: err}
+			}
+			if hooked {
+				return &RuleError{Op: "verify", Table: chain.Table, Chain: chain.Hook, RuleSpec: jump, Err: ErrRulesDrift}
+			}
+		}
+	}
+	return nil
+}
+
+// InstalledChain is an msm-owned chain found in the tables
+type InstalledChain struct {
+	Family string `json:"family"`
+	Table  string `json:"table"`
+	Chain  string `json:"chain"`
+	// Hook is the built-in chain jumping to the chain, empty when nothing jumps to it from a built-in chain
+	Hook string `json:"hook,omitempty"`
+	// Rules are the rules of the chain the way `iptables -S` prints them, without the `-A <chain>` prefix
+	Rules []string `json:"rules"`
+}
+
+// List returns the msm-owned chains installed for the IP family of ipt, whatever parameters programmed them
+func List(ipt *iptables.IPTables) ([]InstalledChain, error) {
+	fam := IPv4
+	if ipt.Proto() == iptables.ProtocolIPv6 {
+		fam = IPv6
+	}
+
+	var installed []InstalledChain
+	for _, chain := range msmChains {
+		exists, err := ipt.ChainExists(chain.Table, chain.Name)
+		if err != nil {
+			return nil, &RuleError{Op: "list", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+		if !exists {
+			continue
+		}
+
+		c := InstalledChain{Family: fam, Table: chain.Table, Chain: chain.Name, Rules: []string{}}
+		if chain.Hook != "" {
+			hooked, err := ipt.Exists(chain.Table, chain.Hook, "-j", chain.Name)
+			if err != nil {
+				return nil, &RuleError{Op: "list", Table: chain.Table, Chain: chain.Hook, Err: err}
+			}
+			if hooked {
+				c.Hook = chain.Hook
+			}
+		}
+
+		listed, err := ipt.List(chain.Table, chain.Name)
+		if err != nil {
+			return nil, &RuleError{Op: "list", Table: chain.Table, Chain: chain.Name, Err: err}
+		}
+		for _, rule := range listed {
+			if spec, found := strings.CutPrefix(rule, "-A "+chain.Name+" "); found {
+				c.Rules = append(c.Rules, spec)
+			}
+		}
+		installed = append(installed, c)
+	}
+	return installed, nil
+}
+
+// findRule returns the index of the first listed rule, starting at from, that matches ruleSpec.
+// iptables adds implicit matches when listing (e.g. `-m tcp`), so a listed rule matches
+// when it contains all the tokens of ruleSpec in the same order.
+func findRule(rules []string, ruleSpec []string, from int) int {
+	for i := from; i < len(rules); i++ {
+		tokens := strings.Fields(rules[i])
+		matched := 0
+		for _, token := range tokens {
+			if matched < len(ruleSpec) && token == ruleSpec[matched] {
+				matched++
+			}
+		}
+		if matched == len(ruleSpec) {
+			return i
+		}
+	}
+	return -1
+}
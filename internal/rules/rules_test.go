@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rules
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestFindRule(t *testing.T) {
+	// the chain the way `iptables -S` lists it, with the implicit matches iptables adds
+	listed := []string{
+		"-A MSM_OUTPUT -d 127.0.0.0/8 -j RETURN",
+		"-A MSM_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN",
+		"-A MSM_OUTPUT -p tcp -m tcp --dport 554 -j MSM_REDIRECT",
+		"-A MSM_OUTPUT -p tcp -m tcp --dport 8000:8010 -j MSM_REDIRECT",
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from int
+		want int
+	}{
+		{"first rule", "-d 127.0.0.0/8 -j RETURN", 0, 0},
+		{"implicit match", "-p tcp --dport 554 -j MSM_REDIRECT", 0, 2},
+		{"port range", "-p tcp --dport 8000:8010 -j MSM_REDIRECT", 0, 3},
+		{"before from", "-d 127.0.0.0/8 -j RETURN", 1, -1},
+		{"other port", "-p tcp --dport 555 -j MSM_REDIRECT", 0, -1},
+		{"tokens out of order", "--dport 554 -p tcp -j MSM_REDIRECT", 0, -1},
+		{"from past the end", "-d 127.0.0.0/8 -j RETURN", len(listed), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findRule(listed, strings.Fields(tt.spec), tt.from); got != tt.want {
+				t.Errorf("findRule(%q, %d) = %d, want %d", tt.spec, tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSet(t *testing.T) {
+	p := redirectParams()
+	p.ExcludeCIDRs = []string{"10.0.0.0/8", "fd00::/8"}
+	p.ExcludeUIDs = []string{"1500"}
+	p.ExcludeGIDs = []string{"2000"}
+	p.InboundPorts = []string{AllPorts}
+	p.InboundExcludePorts = []string{"22"}
+	p.InboundProxyPort = "8555"
+
+	tests := []struct {
+		name  string
+		proto iptables.Protocol
+		want  []string
+	}{
+		{
+			name:  "IPv4",
+			proto: iptables.ProtocolIPv4,
+			want: []string{
+				"nat MSM_OUTPUT -d 127.0.0.0/8 -j RETURN",
+				"nat MSM_OUTPUT -d 10.0.0.0/8 -j RETURN",
+				"nat MSM_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN",
+				"nat MSM_OUTPUT -p tcp -m owner --uid-owner 1500 -j RETURN",
+				"nat MSM_OUTPUT -p tcp -m owner --gid-owner 2000 -j RETURN",
+				"nat MSM_OUTPUT -p tcp --dport 554 -j MSM_REDIRECT",
+				"nat MSM_OUTPUT -p tcp --dport 8000:8010 -j MSM_REDIRECT",
+				"nat MSM_REDIRECT -p tcp -j REDIRECT --to-ports 8554",
+				"nat MSM_IN_REDIRECT -p tcp -j REDIRECT --to-ports 8555",
+				"nat MSM_PREROUTING -p tcp --dport 22 -j RETURN",
+				"nat MSM_PREROUTING -p tcp -j MSM_IN_REDIRECT",
+			},
+		},
+		{
+			name:  "IPv6",
+			proto: iptables.ProtocolIPv6,
+			want: []string{
+				"nat MSM_OUTPUT -d ::1/128 -j RETURN",
+				"nat MSM_OUTPUT -d fd00::/8 -j RETURN",
+				"nat MSM_OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN",
+				"nat MSM_OUTPUT -p tcp -m owner --uid-owner 1500 -j RETURN",
+				"nat MSM_OUTPUT -p tcp -m owner --gid-owner 2000 -j RETURN",
+				"nat MSM_OUTPUT -p tcp --dport 554 -j MSM_REDIRECT",
+				"nat MSM_OUTPUT -p tcp --dport 8000:8010 -j MSM_REDIRECT",
+				"nat MSM_REDIRECT -p tcp -j REDIRECT --to-ports 8554",
+				"nat MSM_IN_REDIRECT -p tcp -j REDIRECT --to-ports 8555",
+				"nat MSM_PREROUTING -p tcp --dport 22 -j RETURN",
+				"nat MSM_PREROUTING -p tcp -j MSM_IN_REDIRECT",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, rule := range RuleSet(p, tt.proto) {
+				got = append(got, rule.Table+" "+rule.Chain+" "+strings.Join(rule.Spec, " "))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("RuleSet() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       func(p *Params)
+		wantErr bool
+	}{
+		{"defaults", func(p *Params) {}, false},
+		{"TPROXY without UDP ports", func(p *Params) { p.RedirectMode = RedirectModeTPROXY }, true},
+		{"unknown redirect mode", func(p *Params) { p.RedirectMode = "DNAT" }, true},
+		{"invalid intercept port", func(p *Params) { p.InterceptPorts = []string{"70000"} }, true},
+		{"invalid UID", func(p *Params) { p.ExcludeUIDs = []string{"-1"} }, true},
+		{"invalid GID", func(p *Params) { p.ExcludeGIDs = []string{"root"} }, true},
+		{"unknown IP family", func(p *Params) { p.IPFamilies = []string{"ipx"} }, true},
+		{"all inbound ports", func(p *Params) {
+			p.InboundPorts = []string{AllPorts}
+			p.InboundProxyPort = "8555"
+		}, false},
+		{"all inbound ports among others", func(p *Params) {
+			p.InboundPorts = []string{AllPorts, "554"}
+			p.InboundProxyPort = "8555"
+		}, true},
+		{"inbound ports without proxy port", func(p *Params) { p.InboundPorts = []string{"554"} }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := redirectParams()
+			tt.p(&p)
+			if err := Validate(p); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// programmedTables returns the tables holding the rules of p the way Apply programs them
+func programmedTables(p Params, proto iptables.Protocol) *fakeTables {
+	f := &fakeTables{proto: proto, chains: map[string][]string{}, jumps: map[string][]string{}, rules: map[string][]string{}}
+	ruleSet := RuleSet(p, proto)
+	for _, chain := range Chains(ruleSet) {
+		f.chains[chain.Table] = append(f.chains[chain.Table], chain.Name)
+		if chain.Hook != "" {
+			f.jumps[chain.Table] = append(f.jumps[chain.Table], chain.Hook+" -j "+chain.Name)
+		}
+	}
+	for _, rule := range ruleSet {
+		key := rule.Table + " " + rule.Chain
+		f.rules[key] = append(f.rules[key], "-A "+rule.Chain+" "+strings.Join(rule.Spec, " "))
+	}
+	return f
+}
+
+func TestVerifyChains(t *testing.T) {
+	tproxy := redirectParams()
+	tproxy.RedirectMode = RedirectModeTPROXY
+	tproxy.UDPInterceptPorts = []string{"20000-30000"}
+	natOutput := natTable + " " + msmOutputChain
+
+	tests := []struct {
+		name   string
+		tables func() *fakeTables
+		want   error
+	}{
+		{
+			name:   "programmed",
+			tables: func() *fakeTables { return programmedTables(redirectParams(), iptables.ProtocolIPv4) },
+		},
+		{
+			name:   "nothing programmed",
+			tables: func() *fakeTables { return &fakeTables{proto: iptables.ProtocolIPv4} },
+			want:   ErrRulesMissing,
+		},
+		{
+			name: "unhooked chain",
+			tables: func() *fakeTables {
+				f := programmedTables(redirectParams(), iptables.ProtocolIPv4)
+				f.jumps[natTable] = nil
+				return f
+			},
+			want: ErrRulesMissing,
+		},
+		{
+			name: "missing rule",
+			tables: func() *fakeTables {
+				f := programmedTables(redirectParams(), iptables.ProtocolIPv4)
+				f.rules[natOutput] = f.rules[natOutput][:2]
+				return f
+			},
+			want: ErrRulesMissing,
+		},
+		{
+			name: "extra rule",
+			tables: func() *fakeTables {
+				f := programmedTables(redirectParams(), iptables.ProtocolIPv4)
+				f.rules[natOutput] = append(f.rules[natOutput], "-A MSM_OUTPUT -p tcp --dport 80 -j MSM_REDIRECT")
+				return f
+			},
+			want: ErrRulesDrift,
+		},
+		{
+			name: "leftover TPROXY chains",
+			tables: func() *fakeTables {
+				f := programmedTables(tproxy, iptables.ProtocolIPv4)
+				redirect := programmedTables(redirectParams(), iptables.ProtocolIPv4)
+				f.chains[natTable], f.jumps[natTable] = redirect.chains[natTable], redirect.jumps[natTable]
+				return f
+			},
+			want: ErrRulesDrift,
+		},
+		{
+			name: "leftover chain unhooked",
+			tables: func() *fakeTables {
+				f := programmedTables(redirectParams(), iptables.ProtocolIPv4)
+				f.chains[natTable] = append(f.chains[natTable], msmInboundRedirChain)
+				return f
+			},
+			want: ErrRulesDrift,
+		},
+		{
+			name: "leftover hook",
+			tables: func() *fakeTables {
+				f := programmedTables(redirectParams(), iptables.ProtocolIPv4)
+				f.jumps[mangleTable] = []string{"OUTPUT -j MSM_OUTPUT"}
+				return f
+			},
+			want: ErrRulesDrift,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyChains(tt.tables(), redirectParams())
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("verifyChains() = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("verifyChains() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
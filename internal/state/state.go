@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package state keeps a record, on the node, of the redirect msm-cni programmed for every attachment.
+// The records are JSON files in a directory shared by the concurrent plugin runs, guarded by a file lock.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
+)
+
+const (
+	// DefaultDir is the directory the records are kept in
+	DefaultDir = "/var/lib/msm-cni"
+	// lockFile guards the records of the directory
+	lockFile = ".lock"
+	// recordSuffix ends the file name of every record
+	recordSuffix = ".json"
+)
+
+// ErrNotFound is returned by Get when there is no record for the attachment
+var ErrNotFound = errors.New("attachment not found in the state store")
+
+// Attachment is the record of the redirect programmed for a pod attachment
+type Attachment struct {
+	// Network is the name of the network configuration the attachment belongs to
+	Network      string `json:"network"`
+	ContainerID  string `json:"containerID"`
+	IfName       string `json:"ifName"`
+	PodName      string `json:"podName"`
+	PodNamespace string `json:"podNamespace"`
+	Netns        string `json:"netns"`
+	// Backend is the InterceptRuleMgr type that programmed the rules
+	Backend  string       `json:"backend"`
+	Params   rules.Params `json:"params"`
+	RuleHash string       `json:"ruleHash"`
+	Created  time.Time    `json:"created"`
+}
+
+// Store keeps the records in a directory
+type Store struct {
+	dir string
+}
+
+// NewStore returns a Store keeping its records in dir, created on the first write
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Put records an attachment, replacing the previous record of the same container ID and interface
+func (s *Store) Put(a *Attachment) error {
+	name, err := recordName(a.ContainerID, a.IfName)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	return s.withLock(unix.LOCK_EX, func() error {
+		// the record is renamed into place, a reader never sees it half written
+		f, err := os.CreateTemp(s.dir, name+".tmp*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(data); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), filepath.Join(s.dir, name))
+	})
+}
+
+// Get returns the record of an attachment, ErrNotFound when there is none
+func (s *Store) Get(containerID, ifName string) (*Attachment, error) {
+	name, err := recordName(containerID, ifName)
+	if err != nil {
+		return nil, err
+	}
+
+	var a *Attachment
+	err = s.withLock(unix.LOCK_SH, func() error {
+		a, err = s.read(name)
+		return err
+	})
+	return a, err
+}
+
+// Delete removes the record of an attachment, it is not an error when there is none
+func (s *Store) Delete(containerID, ifName string) error {
+	name, err := recordName(containerID, ifName)
+	if err != nil {
+		return err
+	}
+
+	return s.withLock(unix.LOCK_EX, func() error {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Prune removes the records of the attachments that are not valid and returns them. The records
+// that cannot be read are removed as well.
+func (s *Store) Prune(valid func(a *Attachment) bool) ([]*Attachment, error) {
+	var pruned []*Attachment
+	err := s.withLock(unix.LOCK_EX, func() error {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasSuffix(name, recordSuffix) {
+				continue
+			}
+			a, err := s.read(name)
+			if err == nil && valid(a) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if a != nil {
+				pruned = append(pruned, a)
+			}
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+func (s *Store) read(name string) (*Attachment, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	a := &Attachment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("invalid record %s: %v", name, err)
+	}
+	return a, nil
+}
+
+// withLock runs f holding the lock of the directory, shared or exclusive as set by how
+func (s *Store) withLock(how int, f func() error) error {
+	// only root programs the rules, nobody else needs the records
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	// closing the file releases the lock
+	defer lock.Close()
+
+	for {
+		err = unix.Flock(int(lock.Fd()), how)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", s.dir, err)
+	}
+	return f()
+}
+
+// recordName returns the file name of the record of an attachment
+func recordName(containerID, ifName string) (string, error) {
+	// the container ID ends at the first _, the interface name may hold more of them
+	if containerID == "" || ifName == "" || strings.ContainsAny(containerID, "/_") || strings.Contains(ifName, "/") {
+		return "", fmt.Errorf("invalid attachment %q %q", containerID, ifName)
+	}
+	return containerID + "_" + ifName + recordSuffix, nil
+}
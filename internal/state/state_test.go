@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2022 Cisco and/or its affiliates.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
+)
+
+func attachment(containerID string) *Attachment {
+	return &Attachment{
+		Network:     "msm",
+		ContainerID: containerID,
+		IfName:      "eth0",
+		Backend:     "iptables",
+		Params:      rules.Params{ProxyPort: "8554", InterceptPorts: []string{"554"}},
+		RuleHash:    "sha256:" + containerID,
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(filepath.Join(t.TempDir(), "state"))
+
+	if _, err := s.Get("c1", "eth0"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get() on an empty store = %v, want ErrNotFound", err)
+	}
+	if err := s.Put(attachment("c1")); err != nil {
+		t.Fatal(err)
+	}
+	replaced := attachment("c1")
+	replaced.RuleHash = "sha256:replaced"
+	if err := s.Put(replaced); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get("c1", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RuleHash != replaced.RuleHash || got.Params.ProxyPort != "8554" {
+		t.Errorf("Get() = %+v, want %+v", got, replaced)
+	}
+
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Errorf("store directory mode = %o, want 700", perm)
+	}
+
+	if err := s.Delete("c1", "eth0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("c1", "eth0"); err != nil {
+		t.Errorf("Delete() of a missing record = %v", err)
+	}
+	if _, err := s.Get("c1", "eth0"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete() = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRecordName(t *testing.T) {
+	tests := []struct {
+		containerID string
+		ifName      string
+		wantErr     bool
+	}{
+		{"c1", "eth0", false},
+		{"c1", "net_1", false},
+		{"", "eth0", true},
+		{"c1", "", true},
+		{"c_1", "eth0", true},
+		{"../c1", "eth0", true},
+		{"c1", "../eth0", true},
+	}
+	for _, tt := range tests {
+		if _, err := recordName(tt.containerID, tt.ifName); (err != nil) != tt.wantErr {
+			t.Errorf("recordName(%q, %q) = %v, wantErr %v", tt.containerID, tt.ifName, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPruneInvalidRecords(t *testing.T) {
+	s := NewStore(t.TempDir())
+	for _, id := range []string{"keep", "drop"} {
+		if err := s.Put(attachment(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, "broken_eth0.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := s.Prune(func(a *Attachment) bool { return a.ContainerID == "keep" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unreadable record is removed without being returned
+	if len(pruned) != 1 || pruned[0].ContainerID != "drop" {
+		t.Errorf("Prune() = %v, want the drop record", pruned)
+	}
+	if _, err := s.Get("keep", "eth0"); err != nil {
+		t.Errorf("Get() of the valid record = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "broken_eth0.json")); !os.IsNotExist(err) {
+		t.Errorf("the unreadable record is still there: %v", err)
+	}
+}
+
+func TestStoreConcurrentPutPrune(t *testing.T) {
+	s := NewStore(t.TempDir())
+	const records = 50
+	even := func(a *Attachment) bool {
+		var n int
+		_, _ = fmt.Sscanf(a.ContainerID, "c%d", &n)
+		return n%2 == 0
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*records)
+	for i := 0; i < records; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.Put(attachment(fmt.Sprintf("c%d", i)))
+		}(i)
+		go func() {
+			defer wg.Done()
+			// every record is valid or not, a half written one would be pruned
+			_, err := s.Prune(even)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Prune(even); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < records; i++ {
+		_, err := s.Get(fmt.Sprintf("c%d", i), "eth0")
+		switch {
+		case i%2 == 0 && err != nil:
+			t.Errorf("Get(c%d) = %v, want the record", i, err)
+		case i%2 == 1 && !errors.Is(err, ErrNotFound):
+			t.Errorf("Get(c%d) = %v, want ErrNotFound", i, err)
+		}
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp") {
+			t.Errorf("temporary record %s left behind", entry.Name())
+		}
+	}
+}
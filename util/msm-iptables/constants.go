@@ -18,12 +18,10 @@ package main
 
 // Constants used as default values cobra/viper CLI
 const (
-	redirectModeREDIRECT      = "REDIRECT"
-	defaultRedirectMode       = redirectModeREDIRECT
 	defaultRedirectToPort     = "8554"
-	defaultRTSPPort           = "554"
 	defaultNoRedirectUID      = "1337"
 	defaultNoRedirectDestAddr = "127.0.0.0/8"
+	defaultInboundProxyPort   = "8555"
 )
 
 // Constants used in cobra/viper CLI
@@ -32,4 +30,30 @@ const (
 	proxyUID             = "proxy-uid"
 	noRedirectDestAddr   = "redir-dest-addr"
 	inboundInterceptMode = "inbound-intercept-mode"
+	excludeCIDRs         = "exclude-cidrs"
+	excludeUIDs          = "exclude-uids"
+	excludeGIDs          = "exclude-gids"
+	ipFamilies           = "ip-families"
+	interceptPorts       = "intercept-ports"
+	redirectMode         = "redirect-mode"
+	udpInterceptPorts    = "udp-intercept-ports"
+	tproxyPort           = "tproxy-port"
+	inboundPorts         = "inbound-ports"
+	inboundExcludePorts  = "inbound-exclude-ports"
+	inboundProxyPort     = "inbound-proxy-port"
+	cleanRules           = "clean"
+	verifyRules          = "verify"
+	outputFormat         = "output"
+)
+
+// Output formats of the list subcommand
+const (
+	outputFormatTable = "table"
+	outputFormatJSON  = "json"
+)
+
+// Exit codes of the verify subcommand
+const (
+	exitCodeRulesMissing = 2
+	exitCodeRulesDrift   = 3
 )
@@ -17,51 +17,195 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"text/tabwriter"
 
-	"github.com/coreos/go-iptables/iptables"
+	goiptables "github.com/coreos/go-iptables/iptables"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/media-streaming-mesh/msm-cni/internal/rules"
 )
 
 var rootCmd = &cobra.Command{
-	Use:    "msm-iptables",
-	Short:  "Set up iptables rules for an MSM Sidecar",
-	Long:   "msm-iptables is responsible for setting up port forwarding for an MSM Sidecar.",
+	Use:   "msm-iptables",
+	Short: "Set up iptables rules for an MSM Sidecar",
+	Long: "msm-iptables is responsible for setting up port forwarding for an MSM Sidecar. It programs the rules " +
+		"when run without a subcommand.",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindFlags(cmd, args)
+		bindRootFlags(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		// --verify and --clean are kept for the callers predating the subcommands
+		switch {
+		case viper.GetBool(verifyRules):
+			verifyCmd.Run(cmd, args)
+		case viper.GetBool(cleanRules):
+			cleanCmd.Run(cmd, args)
+		default:
+			applyCmd.Run(cmd, args)
+		}
+	},
+}
+
+var applyCmd = &cobra.Command{
+	Use:    "apply",
+	Short:  "Set up the redirect rules",
+	Long:   "Rebuild the msm chains with the rules for the given parameters, all IP families or none.",
 	PreRun: bindFlags,
 	Run: func(cmd *cobra.Command, args []string) {
-		ipt, err := iptables.New()
-		if err != nil {
-			handleErrorWithCode(err, 1)
+		params := ruleParams()
+		exitOnError(rules.ApplyAll(newHandles(params), params))
+	},
+}
+
+var cleanCmd = &cobra.Command{
+	Use:    "clean",
+	Short:  "Remove the redirect rules",
+	Long:   "Remove the msm chains and the TPROXY policy routing, only the IP families are taken from the parameters.",
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		params := ruleParams()
+		for _, ipt := range newHandles(params) {
+			exitOnError(rules.Clean(ipt, params))
 		}
+	},
+}
 
-		// iptables -t nat -A OUTPUT -d 127.0.0.0/8 -j RETURN
-		noRedirDestAddrRuleSpec := []string{"-d", viper.GetString(noRedirectDestAddr), "-j", "RETURN"}
-		err = ipt.Append("nat", "OUTPUT", noRedirDestAddrRuleSpec...)
-		if err != nil {
-			handleErrorWithCode(err, 1)
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the redirect rules",
+	Long: "Check that the msm chains hold the rules for the given parameters, in order. It exits with 2 when " +
+		"rules are missing and 3 when they drifted.",
+	PreRun: bindFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		params := ruleParams()
+		for _, ipt := range newHandles(params) {
+			exitOnError(rules.Verify(ipt, params))
 		}
+		log.Info("redirect rules verified")
+	},
+}
 
-		// iptables -t nat -A OUTPUT -p tcp -m owner --uid-owner 1337 -j RETURN
-		uidRulespec := []string{"-p", "tcp", "-m", "owner", "--uid-owner", viper.GetString(proxyUID), "-j", "RETURN"}
-		err = ipt.Append("nat", "OUTPUT", uidRulespec...)
-		if err != nil {
-			handleErrorWithCode(err, 1)
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show the redirect rules",
+	Long: "Show the msm chains installed in the network namespace and their rules, as a table or as JSON. Both IP " +
+		"families are listed unless --ip-families is set, skipping the one whose iptables binary is missing.",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindFlags(cmd, args)
+		if err := viper.BindPFlag(outputFormat, cmd.Flags().Lookup(outputFormat)); err != nil {
+			handleError(err)
+		}
+		viper.SetDefault(outputFormat, outputFormatTable)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		installed := []rules.InstalledChain{}
+		for _, ipt := range listHandles(cmd) {
+			chains, err := rules.List(ipt)
+			exitOnError(err)
+			installed = append(installed, chains...)
+		}
+
+		switch format := viper.GetString(outputFormat); format {
+		case outputFormatJSON:
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			exitOnError(enc.Encode(installed))
+		case outputFormatTable:
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "FAMILY\tTABLE\tCHAIN\tHOOK\tRULE")
+			for _, c := range installed {
+				hook := c.Hook
+				if hook == "" {
+					hook = "-"
+				}
+				if len(c.Rules) == 0 {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t-\n", c.Family, c.Table, c.Chain, hook)
+				}
+				for _, rule := range c.Rules {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Family, c.Table, c.Chain, hook, rule)
+				}
+			}
+			exitOnError(w.Flush())
+		default:
+			handleError(fmt.Errorf("unsupported output format %s", format))
 		}
+	},
+}
 
-		// iptables -t nat -A OUTPUT -p tcp --dport 554 -j REDIRECT --to-ports 8554
-		msmProxyPortRulespec := []string{
-			"-p", "tcp", "--dport", defaultRTSPPort, "-j", redirectModeREDIRECT,
-			"--to-ports", viper.GetString(msmProxyPort),
+// ruleParams returns the rule parameters from the flags
+func ruleParams() rules.Params {
+	return rules.Params{
+		ProxyPort:          viper.GetString(msmProxyPort),
+		ProxyUID:           viper.GetString(proxyUID),
+		NoRedirectDestAddr: viper.GetString(noRedirectDestAddr),
+		ExcludeCIDRs:       viper.GetStringSlice(excludeCIDRs),
+		ExcludeUIDs:        viper.GetStringSlice(excludeUIDs),
+		ExcludeGIDs:        viper.GetStringSlice(excludeGIDs),
+		IPFamilies:         viper.GetStringSlice(ipFamilies),
+		InterceptPorts:     viper.GetStringSlice(interceptPorts),
+		RedirectMode:       viper.GetString(redirectMode),
+		UDPInterceptPorts:  viper.GetStringSlice(udpInterceptPorts),
+		TProxyPort:         viper.GetString(tproxyPort),
+
+		InboundInterceptMode: viper.GetString(inboundInterceptMode),
+		InboundPorts:         viper.GetStringSlice(inboundPorts),
+		InboundExcludePorts:  viper.GetStringSlice(inboundExcludePorts),
+		InboundProxyPort:     viper.GetString(inboundProxyPort),
+	}
+}
+
+// newHandles returns an iptables handle for each IP family of the parameters
+func newHandles(params rules.Params) []*goiptables.IPTables {
+	handles, err := rules.NewIPTables(params)
+	if err != nil {
+		handleError(err)
+	}
+	return handles
+}
+
+// listHandles returns the iptables handles of the IP families given with --ip-families, or else of both
+// families, the chains being listed whatever parameters programmed them
+func listHandles(cmd *cobra.Command) []*goiptables.IPTables {
+	if cmd.Flags().Changed(ipFamilies) {
+		return newHandles(ruleParams())
+	}
+
+	var handles []*goiptables.IPTables
+	for _, proto := range []goiptables.Protocol{goiptables.ProtocolIPv4, goiptables.ProtocolIPv6} {
+		ipt, err := goiptables.NewWithProtocol(proto)
+		if errors.Is(err, exec.ErrNotFound) {
+			log.Debugf("skipping the IP family of protocol %v: %v", proto, err)
+			continue
 		}
-		err = ipt.Append("nat", "OUTPUT", msmProxyPortRulespec...)
 		if err != nil {
-			handleErrorWithCode(err, 1)
+			handleError(err)
 		}
-	},
+		handles = append(handles, ipt)
+	}
+	return handles
+}
+
+// exitOnError exits with the code matching err, if any
+func exitOnError(err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, rules.ErrRulesMissing):
+		handleErrorWithCode(err, exitCodeRulesMissing)
+	case errors.Is(err, rules.ErrRulesDrift):
+		handleErrorWithCode(err, exitCodeRulesDrift)
+	default:
+		handleError(err)
+	}
 }
 
 func main() {
@@ -80,6 +224,7 @@ func handleErrorWithCode(err error, code int) {
 }
 
 // Any viper mutation and binding should be placed in `PreRun` since they should be dynamically bound to the subcommand being executed.
+// The rule flags are persistent flags of the root command, shared by every subcommand.
 func bindFlags(cmd *cobra.Command, args []string) {
 	if err := viper.BindPFlag(msmProxyPort, cmd.Flags().Lookup(msmProxyPort)); err != nil {
 		handleError(err)
@@ -100,15 +245,129 @@ func bindFlags(cmd *cobra.Command, args []string) {
 		handleError(err)
 	}
 	viper.SetDefault(inboundInterceptMode, "")
+
+	if err := viper.BindPFlag(excludeCIDRs, cmd.Flags().Lookup(excludeCIDRs)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(excludeCIDRs, []string{})
+
+	if err := viper.BindPFlag(excludeUIDs, cmd.Flags().Lookup(excludeUIDs)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(excludeUIDs, []string{})
+
+	if err := viper.BindPFlag(excludeGIDs, cmd.Flags().Lookup(excludeGIDs)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(excludeGIDs, []string{})
+
+	if err := viper.BindPFlag(interceptPorts, cmd.Flags().Lookup(interceptPorts)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(interceptPorts, []string{})
+
+	if err := viper.BindPFlag(redirectMode, cmd.Flags().Lookup(redirectMode)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(redirectMode, "")
+
+	if err := viper.BindPFlag(udpInterceptPorts, cmd.Flags().Lookup(udpInterceptPorts)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(udpInterceptPorts, []string{})
+
+	if err := viper.BindPFlag(tproxyPort, cmd.Flags().Lookup(tproxyPort)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(tproxyPort, "")
+
+	if err := viper.BindPFlag(inboundPorts, cmd.Flags().Lookup(inboundPorts)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(inboundPorts, []string{})
+
+	if err := viper.BindPFlag(inboundExcludePorts, cmd.Flags().Lookup(inboundExcludePorts)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(inboundExcludePorts, []string{})
+
+	if err := viper.BindPFlag(inboundProxyPort, cmd.Flags().Lookup(inboundProxyPort)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(inboundProxyPort, defaultInboundProxyPort)
+
+	if err := viper.BindPFlag(ipFamilies, cmd.Flags().Lookup(ipFamilies)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(ipFamilies, []string{rules.IPv4})
+}
+
+// bindRootFlags binds the flags only the root command has
+func bindRootFlags(cmd *cobra.Command) {
+	if err := viper.BindPFlag(cleanRules, cmd.Flags().Lookup(cleanRules)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(cleanRules, false)
+
+	if err := viper.BindPFlag(verifyRules, cmd.Flags().Lookup(verifyRules)); err != nil {
+		handleError(err)
+	}
+	viper.SetDefault(verifyRules, false)
 }
 
 func init() {
-	rootCmd.Flags().StringP(msmProxyPort, "p", "", "Specify the msm port to which redirect all RTSP traffic (default: 8554)")
+	rootCmd.PersistentFlags().StringP(msmProxyPort, "p", "", "Specify the msm port to which redirect all RTSP traffic (default: 8554)")
 
-	rootCmd.Flags().StringP(proxyUID, "u", "", "UID of the user for which the redirection is not applied. The UID of the proxy container")
+	rootCmd.PersistentFlags().StringP(proxyUID, "u", "", "UID of the user for which the redirection is not applied. The UID of the proxy container")
 
-	rootCmd.Flags().StringP(noRedirectDestAddr, "d", "", "The localhost address to return outbound traffic")
+	rootCmd.PersistentFlags().StringP(noRedirectDestAddr, "d", "", "The localhost address to return outbound traffic")
 
-	rootCmd.Flags().StringP(inboundInterceptMode, "m", "",
+	rootCmd.PersistentFlags().StringP(inboundInterceptMode, "m", "",
 		"The mode used to redirect inbound connections to MSM Proxy, default: REDIRECT")
+
+	rootCmd.PersistentFlags().StringSlice(excludeCIDRs, []string{},
+		"Comma separated list of additional IPv4 or IPv6 destination CIDRs for which the redirection is not applied")
+
+	rootCmd.PersistentFlags().StringSlice(excludeUIDs, []string{},
+		"Comma separated list of additional UIDs for which the redirection is not applied")
+
+	rootCmd.PersistentFlags().StringSlice(excludeGIDs, []string{},
+		"Comma separated list of GIDs for which the redirection is not applied")
+
+	rootCmd.PersistentFlags().StringSlice(interceptPorts, []string{},
+		"Comma separated list of destination ports or first-last port ranges redirected to the msm port (default: 554)")
+
+	rootCmd.PersistentFlags().String(redirectMode, "",
+		"The mode used to redirect outbound traffic to MSM Proxy, REDIRECT or TPROXY (default: REDIRECT)")
+
+	rootCmd.PersistentFlags().StringSlice(udpInterceptPorts, []string{},
+		"Comma separated list of destination UDP ports or first-last port ranges steered to the msm proxy in TPROXY mode")
+
+	rootCmd.PersistentFlags().String(tproxyPort, "", "The msm port receiving the UDP traffic in TPROXY mode (default: the msm port)")
+
+	rootCmd.PersistentFlags().StringSlice(inboundPorts, []string{},
+		"Comma separated list of inbound TCP ports or first-last port ranges intercepted, * for all ports (default: none)")
+
+	rootCmd.PersistentFlags().StringSlice(inboundExcludePorts, []string{},
+		"Comma separated list of inbound TCP ports or first-last port ranges never intercepted")
+
+	rootCmd.PersistentFlags().String(inboundProxyPort, "", "The msm port to which redirect the inbound traffic (default: 8555)")
+
+	rootCmd.PersistentFlags().StringSlice(ipFamilies, []string{},
+		"Comma separated list of IP families the rules are set up for, ipv4 and/or ipv6 (default: ipv4)")
+
+	rootCmd.Flags().BoolP(cleanRules, "c", false, "Remove the msm chains and the TPROXY routing instead of adding them")
+	if err := rootCmd.Flags().MarkDeprecated(cleanRules, "use msm-iptables clean"); err != nil {
+		handleError(err)
+	}
+
+	rootCmd.Flags().Bool(verifyRules, false,
+		"Check that the msm chains hold the rules for the same parameters in order instead of adding them")
+	if err := rootCmd.Flags().MarkDeprecated(verifyRules, "use msm-iptables verify"); err != nil {
+		handleError(err)
+	}
+
+	listCmd.Flags().StringP(outputFormat, "o", "", "Output format, table or json (default: table)")
+
+	rootCmd.AddCommand(applyCmd, cleanCmd, verifyCmd, listCmd)
 }